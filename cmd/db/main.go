@@ -12,6 +12,7 @@ import (
 )
 
 var port = flag.Int("port", 2361, "db port")
+var shutdownTimeoutSec = flag.Int("shutdown-timeout-sec", 10, "how long to wait for in-flight requests on shutdown in seconds")
 
 func main() {
 	flag.Parse()
@@ -79,6 +80,11 @@ func main() {
 			},
 		},
 	)
-	router.Start(*port)
+	server := httptools.CreateServer(*port, router.Handler(), httptools.NoTimeouts())
+	server.Start()
 	signal.WaitForTerminationSignal()
+	httptools.ShutdownAll(time.Duration(*shutdownTimeoutSec)*time.Second, server)
+	if err := db.Close(); err != nil {
+		log.Printf("Failed to close db: %s", err)
+	}
 }
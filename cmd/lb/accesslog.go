@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	accessLogJSON     = "json"
+	accessLogCommon   = "common"
+	accessLogCombined = "combined"
+
+	requestIDHeader = "X-Request-Id"
+)
+
+// AccessLogConfig controls the log of the requests served by the balancer.
+// Lines are written in one of the formats "json", "common" or "combined" to
+// the file at Path, or to stdout if it is empty. A file that grows over
+// MaxBytes is rotated, keeping MaxBackups old files named Path.1, Path.2 and
+// so on, Path.1 being the newest.
+type AccessLogConfig struct {
+	Disabled   bool   `json:"disabled"`
+	Format     string `json:"format"`
+	Path       string `json:"path"`
+	MaxBytes   int64  `json:"maxBytes"`
+	MaxBackups int    `json:"maxBackups"`
+}
+
+func (c *AccessLogConfig) normalize() error {
+	if c.MaxBytes < 0 || c.MaxBackups < 0 {
+		return fmt.Errorf("access log settings can not be negative")
+	}
+	if c.Format == "" {
+		c.Format = accessLogJSON
+	}
+	if c.Format != accessLogJSON && c.Format != accessLogCommon && c.Format != accessLogCombined {
+		return fmt.Errorf("unknown access log format %s", c.Format)
+	}
+	if c.MaxBytes == 0 {
+		c.MaxBytes = 100 << 20
+	}
+	if c.MaxBackups == 0 {
+		c.MaxBackups = 5
+	}
+	return nil
+}
+
+// accessEntry describes a single request. UpstreamStatus and UpstreamLatency
+// are those of the last try, the one the response came from.
+type accessEntry struct {
+	Time            time.Time
+	Client          string
+	Method          string
+	URI             string
+	Proto           string
+	Referer         string
+	UserAgent       string
+	RequestID       string
+	Backend         string
+	Retries         int
+	Status          int
+	Bytes           int64
+	UpstreamStatus  int
+	UpstreamLatency time.Duration
+	Latency         time.Duration
+}
+
+func (e *accessEntry) MarshalJSON() ([]byte, error) {
+	type entry struct {
+		Time              time.Time `json:"time"`
+		Client            string    `json:"client"`
+		Method            string    `json:"method"`
+		URI               string    `json:"uri"`
+		Proto             string    `json:"proto"`
+		Referer           string    `json:"referer,omitempty"`
+		UserAgent         string    `json:"userAgent,omitempty"`
+		RequestID         string    `json:"requestId"`
+		Backend           string    `json:"backend,omitempty"`
+		Retries           int       `json:"retries"`
+		Status            int       `json:"status"`
+		Bytes             int64     `json:"bytes"`
+		UpstreamStatus    int       `json:"upstreamStatus,omitempty"`
+		UpstreamLatencyMs float64   `json:"upstreamLatencyMs"`
+		LatencyMs         float64   `json:"latencyMs"`
+	}
+	return json.Marshal(entry{
+		Time:              e.Time,
+		Client:            e.Client,
+		Method:            e.Method,
+		URI:               e.URI,
+		Proto:             e.Proto,
+		Referer:           e.Referer,
+		UserAgent:         e.UserAgent,
+		RequestID:         e.RequestID,
+		Backend:           e.Backend,
+		Retries:           e.Retries,
+		Status:            e.Status,
+		Bytes:             e.Bytes,
+		UpstreamStatus:    e.UpstreamStatus,
+		UpstreamLatencyMs: milliseconds(e.UpstreamLatency),
+		LatencyMs:         milliseconds(e.Latency),
+	})
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// format renders the entry as a single line. The common and combined
+// formats are followed by the fields the balancer adds.
+func (e *accessEntry) format(format string) []byte {
+	if format == accessLogJSON {
+		line, _ := json.Marshal(e)
+		return append(line, '\n')
+	}
+	var line bytes.Buffer
+	size := "-"
+	if e.Bytes > 0 {
+		size = strconv.FormatInt(e.Bytes, 10)
+	}
+	fmt.Fprintf(&line, "%s - - [%s] %s %d %s",
+		orDash(e.Client), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(e.Method+" "+e.URI+" "+e.Proto), e.Status, size)
+	if format == accessLogCombined {
+		fmt.Fprintf(&line, " %s %s", strconv.Quote(orDash(e.Referer)), strconv.Quote(orDash(e.UserAgent)))
+	}
+	upstreamStatus := "-"
+	if e.UpstreamStatus != 0 {
+		upstreamStatus = strconv.Itoa(e.UpstreamStatus)
+	}
+	fmt.Fprintf(&line, " backend=%s upstream_status=%s upstream_latency=%.3f latency=%.3f request_id=%s retries=%d\n",
+		orDash(e.Backend), upstreamStatus, e.UpstreamLatency.Seconds(), e.Latency.Seconds(), orDash(e.RequestID), e.Retries)
+	return line.Bytes()
+}
+
+// accessLog writes access log lines to stdout or to a rotated file. A nil
+// accessLog drops all the lines.
+type accessLog struct {
+	mutex  sync.Mutex
+	config AccessLogConfig
+	out    io.Writer
+	file   *os.File
+	size   int64
+}
+
+// logFile is an access log file opened for appending.
+type logFile struct {
+	file *os.File
+	size int64
+}
+
+func openLogFile(path string) (*logFile, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &logFile{file: file, size: info.Size()}, nil
+}
+
+// open opens the file config writes the log to if it is not the current
+// one, so that install can not fail. It returns nil if there is nothing to
+// open.
+func (l *accessLog) open(config AccessLogConfig) (*logFile, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if config.Disabled || config.Path == "" || (l.out != nil && config.Path == l.config.Path) {
+		return nil, nil
+	}
+	return openLogFile(config.Path)
+}
+
+// install applies config, writing the log to file if it is not nil. The log
+// is reopened only if it is written somewhere else now.
+func (l *accessLog) install(config AccessLogConfig, file *logFile) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	keep := !config.Disabled && file == nil && l.out != nil && config.Path == l.config.Path
+	l.config = config
+	if keep {
+		return
+	}
+	if err := l.closeLocked(); err != nil {
+		log.Printf("Failed to close access log: %s", err)
+	}
+	switch {
+	case config.Disabled:
+	case file != nil:
+		l.file, l.out, l.size = file.file, file.file, file.size
+	default:
+		l.out = os.Stdout
+	}
+}
+
+func (l *accessLog) openLocked() error {
+	file, err := openLogFile(l.config.Path)
+	if err != nil {
+		return err
+	}
+	l.file, l.out, l.size = file.file, file.file, file.size
+	return nil
+}
+
+func (l *accessLog) closeLocked() error {
+	l.out = nil
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// rotateLocked shifts the backups by one, dropping the oldest, and starts a
+// new file.
+func (l *accessLog) rotateLocked() error {
+	if err := l.closeLocked(); err != nil {
+		return err
+	}
+	path := l.config.Path
+	_ = os.Remove(fmt.Sprintf("%s.%d", path, l.config.MaxBackups))
+	for i := l.config.MaxBackups - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+	}
+	err := os.Rename(path, path+".1")
+	if openErr := l.openLocked(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+func (l *accessLog) write(entry *accessEntry) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.out == nil {
+		return
+	}
+	line := entry.format(l.config.Format)
+	if l.file != nil && l.size > 0 && l.size+int64(len(line)) > l.config.MaxBytes {
+		if err := l.rotateLocked(); err != nil {
+			log.Printf("Failed to rotate access log: %s", err)
+			if l.out == nil {
+				return
+			}
+		}
+	}
+	n, err := l.out.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("Failed to write access log: %s", err)
+	}
+}
+
+func (l *accessLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.closeLocked()
+}
+
+// responseLogger records the status and the size of the response for the
+// access log.
+type responseLogger struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseLogger) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseLogger) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *responseLogger) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack takes over the client connection, counting what is written to it
+// for the access log.
+func (w *responseLogger) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection can not be hijacked")
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.status = http.StatusSwitchingProtocols
+	return &countingConn{Conn: conn, bytes: &w.bytes}, buffered, nil
+}
+
+type countingConn struct {
+	net.Conn
+	bytes *int64
+}
+
+func (c *countingConn) Write(data []byte) (int, error) {
+	n, err := c.Conn.Write(data)
+	*c.bytes += int64(n)
+	return n, err
+}
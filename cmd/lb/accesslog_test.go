@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type AccessLogSuite struct{}
+
+var _ = check.Suite(&AccessLogSuite{})
+
+func testEntry() *accessEntry {
+	return &accessEntry{
+		Time:            time.Date(2021, time.May, 4, 10, 20, 30, 0, time.UTC),
+		Client:          "10.0.0.1",
+		Method:          "GET",
+		URI:             "/api?key=1",
+		Proto:           "HTTP/1.1",
+		UserAgent:       "curl/7.68.0",
+		RequestID:       "abc",
+		Backend:         "server1:8080",
+		Retries:         1,
+		Status:          200,
+		Bytes:           42,
+		UpstreamStatus:  200,
+		UpstreamLatency: 15 * time.Millisecond,
+		Latency:         20 * time.Millisecond,
+	}
+}
+
+func (s *AccessLogSuite) TestFormats(c *check.C) {
+	entry := testEntry()
+	c.Check(string(entry.format(accessLogCommon)), check.Equals,
+		`10.0.0.1 - - [04/May/2021:10:20:30 +0000] "GET /api?key=1 HTTP/1.1" 200 42`+
+			" backend=server1:8080 upstream_status=200 upstream_latency=0.015 latency=0.020 request_id=abc retries=1\n")
+	c.Check(string(entry.format(accessLogCombined)), check.Equals,
+		`10.0.0.1 - - [04/May/2021:10:20:30 +0000] "GET /api?key=1 HTTP/1.1" 200 42 "-" "curl/7.68.0"`+
+			" backend=server1:8080 upstream_status=200 upstream_latency=0.015 latency=0.020 request_id=abc retries=1\n")
+
+	var fields map[string]interface{}
+	c.Assert(json.Unmarshal(entry.format(accessLogJSON), &fields), check.IsNil)
+	c.Check(fields["backend"], check.Equals, "server1:8080")
+	c.Check(fields["upstreamLatencyMs"], check.Equals, 15.0)
+	c.Check(fields["retries"], check.Equals, 1.0)
+	c.Check(fields["requestId"], check.Equals, "abc")
+}
+
+func (s *AccessLogSuite) TestRotation(c *check.C) {
+	path := filepath.Join(c.MkDir(), "access.log")
+	line := testEntry().format(accessLogCommon)
+	config := AccessLogConfig{Format: accessLogCommon, Path: path, MaxBytes: int64(2 * len(line)), MaxBackups: 2}
+	c.Assert(config.normalize(), check.IsNil)
+	l := &accessLog{}
+	file, err := l.open(config)
+	c.Assert(err, check.IsNil)
+	l.install(config, file)
+	defer l.Close()
+
+	for i := 0; i < 7; i++ {
+		l.write(testEntry())
+	}
+	for name, lines := range map[string]int{"": 1, ".1": 2, ".2": 2} {
+		data, err := ioutil.ReadFile(path + name)
+		c.Assert(err, check.IsNil)
+		c.Check(strings.Count(string(data), "\n"), check.Equals, lines, check.Commentf("file %s", path+name))
+	}
+	_, err = ioutil.ReadFile(path + ".3")
+	c.Check(err, check.NotNil)
+}
+
+func (s *AccessLogSuite) TestProxy(c *check.C) {
+	failing, failingAddress := testBackend(c, "failing", http.StatusBadGateway)
+	defer failing.Close()
+	good, goodAddress := testBackend(c, "good", 0)
+	defer good.Close()
+	pool := testPool(c, &roundRobin{}, failingAddress, goodAddress)
+	defer pool.Stop()
+
+	path := filepath.Join(c.MkDir(), "access.log")
+	config := AccessLogConfig{Path: path}
+	c.Assert(config.normalize(), check.IsNil)
+	l := &accessLog{}
+	file, err := l.open(config)
+	c.Assert(err, check.IsNil)
+	l.install(config, file)
+	defer l.Close()
+	handler := &proxy{pool: pool, accessLog: l}
+
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/data?key=1", nil)
+	r.Header.Set(requestIDHeader, "req-1")
+	handler.ServeHTTP(rw, r)
+	c.Check(rw.Code, check.Equals, http.StatusOK)
+	c.Check(rw.Header().Get(requestIDHeader), check.Equals, "req-1")
+	rw = serve(handler, "GET", "/data", "")
+	generated := rw.Header().Get(requestIDHeader)
+	c.Check(generated, check.Not(check.Equals), "")
+
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	c.Assert(lines, check.HasLen, 2)
+	var first, second map[string]interface{}
+	c.Assert(json.Unmarshal([]byte(lines[0]), &first), check.IsNil)
+	c.Assert(json.Unmarshal([]byte(lines[1]), &second), check.IsNil)
+	c.Check(first["uri"], check.Equals, "/data?key=1")
+	c.Check(first["requestId"], check.Equals, "req-1")
+	c.Check(first["backend"], check.Equals, goodAddress)
+	c.Check(first["retries"], check.Equals, 1.0)
+	c.Check(first["status"], check.Equals, 200.0)
+	c.Check(first["bytes"], check.Equals, float64(len("good GET ")))
+	c.Check(second["requestId"], check.Equals, generated)
+	c.Check(second["retries"], check.Equals, 1.0)
+	c.Check(fmt.Sprint(second["client"]), check.Equals, "192.0.2.1")
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/burbokop/balanser/httptools"
+)
+
+type BackendStatus struct {
+	Address              string    `json:"address"`
+	Weight               int       `json:"weight"`
+	EffectiveWeight      float64   `json:"effectiveWeight"`
+	Scheme               string    `json:"scheme"`
+	Mode                 string    `json:"mode"`
+	Alive                bool      `json:"alive"`
+	Ejected              bool      `json:"ejected"`
+	Breaker              string    `json:"breaker"`
+	ActiveConnections    int64     `json:"activeConnections"`
+	OpenConnections      int64     `json:"openConnections"`
+	OpenedConnections    uint64    `json:"openedConnections"`
+	ReusedConnections    uint64    `json:"reusedConnections"`
+	DialFailures         uint64    `json:"dialFailures"`
+	Requests             uint64    `json:"requests"`
+	Failures             uint64    `json:"failures"`
+	LatencyMs            float64   `json:"latencyMs"`
+	LastCheck            time.Time `json:"lastCheck"`
+	LastError            string    `json:"lastError,omitempty"`
+	ConsecutiveSuccesses int       `json:"consecutiveSuccesses"`
+	ConsecutiveFailures  int       `json:"consecutiveFailures"`
+	CheckLatencyMs       float64   `json:"checkLatencyMs"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func newBackendStatus(s Server) BackendStatus {
+	connections := s.Connections()
+	return BackendStatus{
+		Address:              s.Name,
+		Weight:               s.Weight,
+		EffectiveWeight:      s.effectiveWeight(),
+		Scheme:               s.Scheme,
+		Mode:                 s.Mode,
+		Alive:                s.IsAlive,
+		Ejected:              s.Ejected,
+		Breaker:              s.Breaker,
+		ActiveConnections:    s.ActiveConnections(),
+		OpenConnections:      connections.Open,
+		OpenedConnections:    connections.Opened,
+		ReusedConnections:    connections.Reused,
+		DialFailures:         connections.DialFailures,
+		Requests:             s.Stats.Requests,
+		Failures:             s.Stats.Failures,
+		LatencyMs:            milliseconds(s.Stats.Latency),
+		LastCheck:            s.Health.LastCheck,
+		LastError:            s.Health.LastError,
+		ConsecutiveSuccesses: s.Health.ConsecutiveSuccesses,
+		ConsecutiveFailures:  s.Health.ConsecutiveFailures,
+		CheckLatencyMs:       milliseconds(s.Health.Latency),
+	}
+}
+
+func findBackend(b *Balancer, r *http.Request) (*BackendStatus, error) {
+	address, err := httptools.GetStringFromPath("address", r)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range b.pool.Servers() {
+		if s.Name == address {
+			status := newBackendStatus(s)
+			return &status, nil
+		}
+	}
+	return nil, errUnknownBackend
+}
+
+// newAdminRouter serves the admin API of b. The backends and the strategy it
+// manages are the ones of the default pool, the metrics cover all pools.
+func newAdminRouter(b *Balancer) *httptools.Router {
+	return httptools.NewRouter(
+		[]httptools.Route{
+			{
+				Name:        "metrics",
+				Method:      "GET",
+				Pattern:     "/metrics",
+				HandlerFunc: metricsHandler(b.Pools),
+			},
+			{
+				Name:    "list-backends",
+				Method:  "GET",
+				Pattern: "/backends",
+				HandlerFunc: func(writer http.ResponseWriter, request *http.Request) {
+					servers := b.pool.Servers()
+					result := make([]BackendStatus, len(servers))
+					for i, s := range servers {
+						result[i] = newBackendStatus(s)
+					}
+					httptools.WriteJSONResponseOrDie(writer, http.StatusOK, result)
+				},
+			},
+			{
+				Name:    "get-backend",
+				Method:  "GET",
+				Pattern: "/backends/{address}",
+				HandlerFunc: func(writer http.ResponseWriter, request *http.Request) {
+					status, err := findBackend(b, request)
+					if err != nil {
+						httptools.WriteError(writer, http.StatusNotFound, err)
+						return
+					}
+					httptools.WriteJSONResponseOrDie(writer, http.StatusOK, status)
+				},
+			},
+			{
+				Name:    "add-backend",
+				Method:  "POST",
+				Pattern: "/backends",
+				HandlerFunc: func(writer http.ResponseWriter, request *http.Request) {
+					backend := BackendConfig{}
+					err := httptools.DecodeBodyAndClose(request.Body, &backend)
+					if err != nil {
+						httptools.WriteError(writer, http.StatusBadRequest, err)
+						return
+					}
+					err = b.AddBackend(backend)
+					if err != nil {
+						httptools.WriteError(writer, http.StatusBadRequest, err)
+						return
+					}
+					for _, s := range b.pool.Servers() {
+						if s.Name == backend.Address {
+							httptools.WriteJSONResponseOrDie(writer, http.StatusCreated, newBackendStatus(s))
+							return
+						}
+					}
+				},
+			},
+			{
+				Name:    "remove-backend",
+				Method:  "DELETE",
+				Pattern: "/backends/{address}",
+				HandlerFunc: func(writer http.ResponseWriter, request *http.Request) {
+					address, err := httptools.GetStringFromPath("address", request)
+					if err != nil {
+						httptools.WriteError(writer, http.StatusBadRequest, err)
+						return
+					}
+					err = b.RemoveBackend(address)
+					if err == errUnknownBackend {
+						httptools.WriteError(writer, http.StatusNotFound, err)
+						return
+					}
+					if err != nil {
+						httptools.WriteError(writer, http.StatusBadRequest, err)
+						return
+					}
+					writer.WriteHeader(http.StatusNoContent)
+				},
+			},
+			{
+				Name:    "set-backend-mode",
+				Method:  "PUT",
+				Pattern: "/backends/{address}/mode",
+				HandlerFunc: func(writer http.ResponseWriter, request *http.Request) {
+					address, err := httptools.GetStringFromPath("address", request)
+					if err != nil {
+						httptools.WriteError(writer, http.StatusBadRequest, err)
+						return
+					}
+					type Body struct {
+						Mode string `json:"mode"`
+					}
+					body := &Body{}
+					err = httptools.DecodeBodyAndClose(request.Body, body)
+					if err != nil {
+						httptools.WriteError(writer, http.StatusBadRequest, err)
+						return
+					}
+					err = b.pool.SetMode(address, body.Mode)
+					if err == errUnknownBackend {
+						httptools.WriteError(writer, http.StatusNotFound, err)
+						return
+					}
+					if err != nil {
+						httptools.WriteError(writer, http.StatusBadRequest, err)
+						return
+					}
+					status, err := findBackend(b, request)
+					if err != nil {
+						httptools.WriteError(writer, http.StatusNotFound, err)
+						return
+					}
+					httptools.WriteJSONResponseOrDie(writer, http.StatusOK, status)
+				},
+			},
+			{
+				Name:    "get-strategy",
+				Method:  "GET",
+				Pattern: "/strategy",
+				HandlerFunc: func(writer http.ResponseWriter, request *http.Request) {
+					type Body struct {
+						Name      string   `json:"name"`
+						Available []string `json:"available"`
+					}
+					httptools.WriteJSONResponseOrDie(writer, http.StatusOK, Body{
+						Name:      strategyName(b.Config().Strategy),
+						Available: StrategyNames(),
+					})
+				},
+			},
+			{
+				Name:    "set-strategy",
+				Method:  "PUT",
+				Pattern: "/strategy",
+				HandlerFunc: func(writer http.ResponseWriter, request *http.Request) {
+					type Body struct {
+						Name string `json:"name"`
+					}
+					body := &Body{}
+					err := httptools.DecodeBodyAndClose(request.Body, body)
+					if err != nil {
+						httptools.WriteError(writer, http.StatusBadRequest, err)
+						return
+					}
+					if body.Name == "" {
+						httptools.WriteError(writer, http.StatusBadRequest, fmt.Errorf("name can not be empty"))
+						return
+					}
+					err = b.SetStrategy(body.Name)
+					if err != nil {
+						httptools.WriteError(writer, http.StatusBadRequest, err)
+						return
+					}
+					httptools.WriteJSONResponseOrDie(writer, http.StatusOK, body)
+				},
+			},
+		},
+	)
+}
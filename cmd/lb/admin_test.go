@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type AdminSuite struct{}
+
+var _ = check.Suite(&AdminSuite{})
+
+func adminRequest(c *check.C, handler http.Handler, method, target, body string, v interface{}) int {
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest(method, target, strings.NewReader(body)))
+	if v != nil {
+		c.Assert(json.NewDecoder(rw.Body).Decode(v), check.IsNil)
+	}
+	return rw.Code
+}
+
+func (s *AdminSuite) TestBackends(c *check.C) {
+	config := &Config{}
+	c.Assert(config.normalize(), check.IsNil)
+	balancer, err := NewBalancer(config)
+	c.Assert(err, check.IsNil)
+	balancer.pool.prober = fakeProber("server1:8080", "server2:8080")
+	defer balancer.pool.Stop()
+	handler := newAdminRouter(balancer).Handler()
+
+	var status BackendStatus
+	code := adminRequest(c, handler, "POST", "/backends", `{"address": "server1:8080", "weight": 2}`, &status)
+	c.Check(code, check.Equals, http.StatusCreated)
+	c.Check(status.Address, check.Equals, "server1:8080")
+	c.Check(status.Weight, check.Equals, 2)
+	c.Check(status.Mode, check.Equals, ModeActive)
+
+	code = adminRequest(c, handler, "POST", "/backends", `{"address": "server1:8080"}`, nil)
+	c.Check(code, check.Equals, http.StatusBadRequest)
+	code = adminRequest(c, handler, "POST", "/backends", `{"address": "server2:8080"}`, nil)
+	c.Check(code, check.Equals, http.StatusCreated)
+	waitFor(c, func() bool { return len(aliveIndexes(balancer.pool.Servers())) == 2 })
+
+	var list []BackendStatus
+	code = adminRequest(c, handler, "GET", "/backends", "", &list)
+	c.Check(code, check.Equals, http.StatusOK)
+	c.Assert(list, check.HasLen, 2)
+	c.Check(list[1].Alive, check.Equals, true)
+	c.Check(list[1].LastCheck.IsZero(), check.Equals, false)
+
+	code = adminRequest(c, handler, "PUT", "/backends/server1:8080/mode", `{"mode": "draining"}`, &status)
+	c.Check(code, check.Equals, http.StatusOK)
+	c.Check(status.Mode, check.Equals, ModeDraining)
+	c.Check(status.Alive, check.Equals, false)
+	code = adminRequest(c, handler, "PUT", "/backends/server1:8080/mode", `{"mode": "sleeping"}`, nil)
+	c.Check(code, check.Equals, http.StatusBadRequest)
+	code = adminRequest(c, handler, "PUT", "/backends/server9:8080/mode", `{"mode": "disabled"}`, nil)
+	c.Check(code, check.Equals, http.StatusNotFound)
+
+	code = adminRequest(c, handler, "DELETE", "/backends/server2:8080", "", nil)
+	c.Check(code, check.Equals, http.StatusNoContent)
+	code = adminRequest(c, handler, "GET", "/backends/server2:8080", "", nil)
+	c.Check(code, check.Equals, http.StatusNotFound)
+	code = adminRequest(c, handler, "DELETE", "/backends/server2:8080", "", nil)
+	c.Check(code, check.Equals, http.StatusNotFound)
+	c.Check(balancer.pool.Servers(), check.HasLen, 1)
+}
+
+func (s *AdminSuite) TestStrategy(c *check.C) {
+	config := &Config{}
+	c.Assert(config.normalize(), check.IsNil)
+	balancer, err := NewBalancer(config)
+	c.Assert(err, check.IsNil)
+	handler := newAdminRouter(balancer).Handler()
+
+	var body struct {
+		Name      string
+		Available []string
+	}
+	code := adminRequest(c, handler, "GET", "/strategy", "", &body)
+	c.Check(code, check.Equals, http.StatusOK)
+	c.Check(body.Name, check.Equals, defaultStrategy)
+	c.Check(body.Available, check.DeepEquals, StrategyNames())
+
+	code = adminRequest(c, handler, "PUT", "/strategy", `{"name": "round-robin"}`, nil)
+	c.Check(code, check.Equals, http.StatusOK)
+	c.Check(balancer.pool.strategy, check.FitsTypeOf, &roundRobin{})
+	code = adminRequest(c, handler, "PUT", "/strategy", `{"name": "unknown"}`, nil)
+	c.Check(code, check.Equals, http.StatusBadRequest)
+	c.Check(balancer.Config().Strategy, check.Equals, "round-robin")
+}
+
+func (s *AdminSuite) TestDisabledBackendIsNotChecked(c *check.C) {
+	b := newBackend(testBackendConfig("server1:8080"), fakeProber("server1:8080"))
+	b.start()
+	defer b.halt()
+	waitFor(c, func() bool { return b.Snapshot().IsAlive })
+
+	c.Check(b.setMode(ModeDisabled), check.IsNil)
+	c.Check(b.stop, check.IsNil)
+	c.Check(b.Snapshot().IsAlive, check.Equals, false)
+
+	c.Check(b.setMode(ModeActive), check.IsNil)
+	waitFor(c, func() bool { return b.Snapshot().IsAlive })
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthState is the history of the health checks of a backend.
+type HealthState struct {
+	LastCheck            time.Time
+	LastError            string
+	ConsecutiveSuccesses int
+	ConsecutiveFailures  int
+	Latency              time.Duration
+}
+
+const (
+	// ModeActive backends get requests whenever they are healthy.
+	ModeActive = "active"
+	// ModeDraining backends get no new requests but finish the ones they
+	// have, so they can be removed without failing requests.
+	ModeDraining = "draining"
+	// ModeDisabled backends get no requests and are not health checked.
+	ModeDisabled = "disabled"
+)
+
+// RequestStats summarizes the requests forwarded to a backend.
+type RequestStats struct {
+	Requests uint64
+	Failures uint64
+	// Latency is the exponentially weighted moving average of the request
+	// latency.
+	Latency time.Duration
+}
+
+// Server is a snapshot of a Backend taken when a request is balanced.
+// Strategies only ever see snapshots, so the state they choose by can not
+// change in the middle of a decision.
+type Server struct {
+	Name       string
+	Weight     int
+	Scheme     string
+	HealthPath string
+	Mode       string
+	// Healthy is true if the backend passes its health checks.
+	Healthy bool
+	// IsAlive is false if the backend failed its health checks, is ejected,
+	// its circuit breaker does not let requests through or it is not
+	// active.
+	IsAlive bool
+	Ejected bool
+	Breaker string
+	// Ramp is the share of its weight the backend gets in its slow start
+	// window, 0 outside of it.
+	Ramp   float64
+	Health HealthState
+	Stats  RequestStats
+
+	backend   *Backend
+	transport *backendTransport
+}
+
+// ActiveConnections returns the number of requests currently forwarded to
+// the backend.
+func (s *Server) ActiveConnections() int64 {
+	if s.backend == nil {
+		return 0
+	}
+	return s.backend.ActiveConnections()
+}
+
+// track marks the beginning of a forwarded request, the returned function
+// marks its end.
+func (s *Server) track() func() {
+	if s.backend == nil {
+		return func() {}
+	}
+	atomic.AddInt64(&s.backend.active, 1)
+	return func() { atomic.AddInt64(&s.backend.active, -1) }
+}
+
+// acquire asks the circuit breaker of the backend for a permission to send a
+// request to it.
+func (s *Server) acquire() bool {
+	if s.backend == nil {
+		return true
+	}
+	return s.backend.breaker.acquire(time.Now())
+}
+
+// release gives back the permission taken by acquire when the request was
+// not sent to the backend after all.
+func (s *Server) release() {
+	if s.backend != nil {
+		s.backend.breaker.release()
+	}
+}
+
+// cancelled records a request sent to the backend that the client gave up
+// on before it answered.
+func (s *Server) cancelled() {
+	if s.backend != nil {
+		s.backend.breaker.cancel(time.Now())
+	}
+}
+
+// retried counts a retry of a request that failed on the backend.
+func (s *Server) retried() {
+	if s.backend != nil {
+		s.backend.metrics.retry()
+	}
+}
+
+// Connections returns the counters of the connections to the backend.
+func (s *Server) Connections() ConnectionStats {
+	if s.backend == nil {
+		return ConnectionStats{}
+	}
+	return s.backend.metrics.snapshot().Connections
+}
+
+// client returns the HTTP client for the requests to the backend.
+func (s *Server) client() *http.Client {
+	if s.transport == nil {
+		return http.DefaultClient
+	}
+	return &http.Client{Transport: s.transport}
+}
+
+// roundTripper returns the transport of the backend. Unlike client, it
+// sends a single request and leaves redirects to the caller.
+func (s *Server) roundTripper() http.RoundTripper {
+	if s.transport == nil {
+		return http.DefaultTransport
+	}
+	return s.transport
+}
+
+// dial connects to the backend outside of its transport, but with the same
+// settings.
+func (s *Server) dial(ctx context.Context) (net.Conn, error) {
+	if s.transport == nil {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", s.Name)
+	}
+	return s.transport.dial(ctx, "tcp", s.Name)
+}
+
+// tlsConfig returns the TLS settings for the connections to the backend
+// made outside of its transport.
+func (s *Server) tlsConfig() *tls.Config {
+	config := &tls.Config{}
+	if s.transport != nil && s.transport.TLSClientConfig != nil {
+		config = s.transport.TLSClientConfig.Clone()
+		// The transport may have offered HTTP/2 with the same settings.
+		config.NextProtos = nil
+	}
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(s.Name)
+	}
+	return config
+}
+
+// Backend is the live state of a pool member shared by its health checker,
+// the request handlers and the pool.
+type Backend struct {
+	// active is accessed atomically and goes first to stay 64-bit aligned.
+	active int64
+
+	prober  Prober
+	breaker circuitBreaker
+	metrics backendMetrics
+
+	mutex     sync.RWMutex
+	config    BackendConfig
+	transport *backendTransport
+	mode      string
+	alive     bool
+	health    HealthState
+	stats     RequestStats
+	stop      chan struct{}
+
+	passiveFailures int
+	ejections       int
+	ejectedUntil    time.Time
+
+	slowStart    SlowStartConfig
+	healthySince time.Time
+}
+
+func newBackend(config BackendConfig, prober Prober) *Backend {
+	b := &Backend{config: config, prober: prober, mode: ModeActive}
+	b.breaker.name = config.Address
+	return b
+}
+
+func (b *Backend) Snapshot() Server {
+	now := time.Now()
+	breaker, allowed := b.breaker.current(now)
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	ejected := now.Before(b.ejectedUntil)
+	return Server{
+		Name:       b.config.Address,
+		Weight:     b.config.Weight,
+		Scheme:     b.config.Scheme,
+		HealthPath: b.config.HealthPath,
+		Mode:       b.mode,
+		Healthy:    b.alive,
+		IsAlive:    b.alive && !ejected && allowed && b.mode == ModeActive,
+		Ejected:    ejected,
+		Breaker:    breaker.String(),
+		Ramp:       b.rampLocked(now),
+		Health:     b.health,
+		Stats:      b.stats,
+		backend:    b,
+		transport:  b.transport,
+	}
+}
+
+func (b *Backend) ActiveConnections() int64 {
+	return atomic.LoadInt64(&b.active)
+}
+
+func (b *Backend) Config() BackendConfig {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.config
+}
+
+// setMode changes the mode of the backend, stopping health checks of
+// disabled backends.
+func (b *Backend) setMode(mode string) error {
+	if mode != ModeActive && mode != ModeDraining && mode != ModeDisabled {
+		return fmt.Errorf("unknown backend mode %s", mode)
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if mode == b.mode {
+		return nil
+	}
+	log.Printf("Backend %s is %s", b.config.Address, mode)
+	switch {
+	case mode == ModeDisabled && b.stop != nil:
+		b.haltLocked()
+		b.alive = false
+	case b.mode == ModeDisabled && b.stop == nil:
+		b.startLocked()
+	}
+	b.mode = mode
+	return nil
+}
+
+func (b *Backend) recordRequest(failed bool, latency time.Duration) {
+	const alpha = 0.2
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.stats.Requests++
+	if failed {
+		b.stats.Failures++
+	}
+	if b.stats.Requests == 1 {
+		b.stats.Latency = latency
+	} else {
+		b.stats.Latency += time.Duration(alpha * float64(latency-b.stats.Latency))
+	}
+}
+
+// setTransport makes the backend send requests through a new transport with
+// the given settings and closes the idle connections of the old one.
+func (b *Backend) setTransport(config TransportConfig, tlsConfig *tls.Config) {
+	transport := newBackendTransport(config, tlsConfig, &b.metrics)
+	b.mutex.Lock()
+	old := b.transport
+	b.transport = transport
+	b.mutex.Unlock()
+	if old != nil {
+		old.CloseIdleConnections()
+	}
+}
+
+// closeIdleConnections closes the connections to the backend not used by any
+// request.
+func (b *Backend) closeIdleConnections() {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if b.transport != nil {
+		b.transport.CloseIdleConnections()
+	}
+}
+
+// reconfigure applies config to the backend. If the way the backend is probed
+// changes, its health history is dropped and the checker is restarted.
+func (b *Backend) reconfigure(config BackendConfig) (restarted bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	restarted = config.Scheme != b.config.Scheme ||
+		!reflect.DeepEqual(config.HealthCheck, b.config.HealthCheck)
+	b.config = config
+	if restarted {
+		b.alive = false
+		b.health = HealthState{}
+		if b.stop != nil {
+			b.haltLocked()
+			b.startLocked()
+		}
+	}
+	return restarted
+}
+
+// start launches the health checker of the backend.
+func (b *Backend) start() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.stop == nil && b.mode != ModeDisabled {
+		b.startLocked()
+	}
+}
+
+// halt stops the health checker of the backend.
+func (b *Backend) halt() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.stop != nil {
+		b.haltLocked()
+	}
+}
+
+func (b *Backend) startLocked() {
+	stop := make(chan struct{})
+	b.stop = stop
+	go b.check(stop)
+}
+
+func (b *Backend) haltLocked() {
+	close(b.stop)
+	b.stop = nil
+}
+
+// healthCheck returns the health check settings of the backend, falling
+// back to the defaults for configs that were not normalized.
+func (b *Backend) healthCheck() HealthCheckConfig {
+	if b.config.HealthCheck == nil {
+		return defaultHealthCheck()
+	}
+	return *b.config.HealthCheck
+}
+
+func (b *Backend) check(stop <-chan struct{}) {
+	b.mutex.RLock()
+	check := b.healthCheck()
+	b.mutex.RUnlock()
+
+	ticker := time.NewTicker(time.Duration(check.Interval))
+	defer ticker.Stop()
+	for {
+		dst := b.Snapshot()
+		start := time.Now()
+		err := b.prober(dst, check)
+		b.record(stop, start, time.Since(start), err)
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// record stores the result of a probe made by the checker owning stop.
+func (b *Backend) record(stop <-chan struct{}, at time.Time, latency time.Duration, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.stop != stop {
+		// The checker was stopped or restarted while probing, its result is
+		// stale.
+		return
+	}
+	b.metrics.check(err)
+	first := b.health.LastCheck.IsZero()
+	check := b.healthCheck()
+	b.health.LastCheck = at
+	b.health.Latency = latency
+	if err != nil {
+		b.health.LastError = err.Error()
+		b.health.ConsecutiveFailures++
+		b.health.ConsecutiveSuccesses = 0
+		if b.alive && b.health.ConsecutiveFailures >= check.Fall {
+			log.Printf("Backend %s is down: %s", b.config.Address, err)
+		}
+		if first || b.health.ConsecutiveFailures >= check.Fall {
+			b.alive = false
+		}
+	} else {
+		b.health.LastError = ""
+		b.health.ConsecutiveSuccesses++
+		b.health.ConsecutiveFailures = 0
+		if !b.alive && (first || b.health.ConsecutiveSuccesses >= check.Rise) {
+			log.Printf("Backend %s is up", b.config.Address)
+			b.alive = true
+			if !first {
+				b.healthySince = at
+			}
+		}
+	}
+}
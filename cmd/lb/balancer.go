@@ -1,14 +1,10 @@
 package main
 
 import (
-	"context"
+	"crypto/tls"
 	"flag"
-	"fmt"
-	"hash/fnv"
-	"io"
 	"log"
-	"net/http"
-	"net/url"
+	"sync"
 	"time"
 
 	"github.com/burbokop/balanser/httptools"
@@ -19,24 +15,22 @@ var (
 	port       = flag.Int("port", 8090, "load balancer port")
 	timeoutSec = flag.Int("timeout-sec", 3, "request timeout time in seconds")
 	https      = flag.Bool("https", false, "whether backends support HTTPs")
+	strategy   = flag.String("strategy", "", "balancing strategy, overrides the one from config (default "+defaultStrategy+")")
 
-	traceEnabled = flag.Bool("trace", false, "whether to include tracing information into responses")
-)
+	configPath    = flag.String("config", "", "path to JSON file with the backends pool, built-in pool is used if empty")
+	configPollSec = flag.Int("config-poll-sec", 5, "how often to check the config file for changes in seconds")
 
-type Server struct {
-	Name    string
-	IsAlive bool
-}
+	adminPort = flag.Int("admin-port", 0, "admin API and metrics port, both are disabled if 0")
 
-var (
-	timeout     = time.Duration(*timeoutSec) * time.Second
-	serversPool = []Server{
-		{Name: "server1:8080", IsAlive: false},
-		{Name: "server2:8080", IsAlive: false},
-		{Name: "server3:8080", IsAlive: false},
-	}
+	redirectPort = flag.Int("redirect-port", 0, "port redirecting HTTP requests to HTTPS when TLS is configured, disabled if 0")
+
+	shutdownTimeoutSec = flag.Int("shutdown-timeout-sec", 10, "how long to wait for in-flight requests on shutdown in seconds")
+
+	traceEnabled = flag.Bool("trace", false, "whether to include tracing information into responses")
 )
 
+var timeout = time.Duration(*timeoutSec) * time.Second
+
 func scheme() string {
 	if *https {
 		return "https"
@@ -44,94 +38,317 @@ func scheme() string {
 	return "http"
 }
 
-func health(dst string) bool {
-	ctx, _ := context.WithTimeout(context.Background(), timeout)
-	req, _ := http.NewRequestWithContext(ctx, "GET",
-		fmt.Sprintf("%s://%s/health", scheme(), dst), nil)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return false
+func loadConfig() (*Config, error) {
+	config := defaultConfig()
+	if *configPath != "" {
+		var err error
+		config, err = LoadConfig(*configPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if *strategy != "" {
+		config.Strategy = *strategy
+	}
+	return config, nil
+}
+
+// Balancer owns the pools and the config they are built from. The config is
+// changed both by reloads and through the admin API; changes made through
+// the admin API last until the next reload.
+type Balancer struct {
+	mutex  sync.Mutex
+	config *Config
+	// pool is the default one, it is never replaced.
+	pool         *Pool
+	pools        map[string]*Pool
+	routes       *routeTable
+	accessLog    *accessLog
+	forwarder    *forwarder
+	limiter      *rateLimiter
+	certificates *certStore
+}
+
+func NewBalancer(config *Config) (*Balancer, error) {
+	b := &Balancer{
+		config:       config,
+		routes:       &routeTable{},
+		accessLog:    &accessLog{},
+		forwarder:    &forwarder{},
+		limiter:      &rateLimiter{},
+		certificates: &certStore{},
+	}
+	if err := b.applyLocked(config); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Config returns the current config, it must not be modified.
+func (b *Balancer) Config() *Config {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.config
+}
+
+// Pools returns the current pools by name.
+func (b *Balancer) Pools() map[string]*Pool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	pools := make(map[string]*Pool, len(b.pools))
+	for name, pool := range b.pools {
+		pools[name] = pool
+	}
+	return pools
+}
+
+// Stop terminates the health checkers of all pools.
+func (b *Balancer) Stop() {
+	for _, pool := range b.Pools() {
+		pool.Stop()
 	}
-	if resp.StatusCode != http.StatusOK {
-		return false
+}
+
+// Apply makes config the current one.
+func (b *Balancer) Apply(config *Config) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.applyLocked(config)
+}
+
+// applyLocked makes config the current one. Everything of config that can
+// fail to load is loaded before anything is changed, so a config that fails
+// leaves the current one in place.
+func (b *Balancer) applyLocked(config *Config) error {
+	loaded, err := b.load(config)
+	if err != nil {
+		return err
 	}
-	return true
+	b.certificates.install(loaded.certificates)
+	b.accessLog.install(config.AccessLog, loaded.logFile)
+	b.forwarder.configure(config.Forwarding)
+	b.limiter.configure(config.RateLimit)
+	b.configurePools(config, loaded)
+	b.config = config
+	return nil
 }
 
-func forward(dst string, rw http.ResponseWriter, r *http.Request) error {
-	ctx, _ := context.WithTimeout(r.Context(), timeout)
-	fwdRequest := r.Clone(ctx)
-	fwdRequest.RequestURI = ""
-	fwdRequest.URL.Host = dst
-	fwdRequest.URL.Scheme = scheme()
-	fwdRequest.Host = dst
+// loadedConfig holds the parts of a config read by load.
+type loadedConfig struct {
+	certificates *certSet
+	logFile      *logFile
+	// strategies of the pools whose strategy changed.
+	strategies  map[string]Strategy
+	upstreamTLS map[string]*tls.Config
+}
 
-	resp, err := http.DefaultClient.Do(fwdRequest)
-	if err == nil {
-		for k, values := range resp.Header {
-			for _, value := range values {
-				rw.Header().Add(k, value)
+// load reads the files config refers to and builds the parts of it that
+// may be invalid.
+func (b *Balancer) load(config *Config) (*loadedConfig, error) {
+	loaded := &loadedConfig{
+		strategies:  make(map[string]Strategy),
+		upstreamTLS: make(map[string]*tls.Config),
+	}
+	var oldConfigs map[string]*PoolConfig
+	if b.config != nil {
+		oldConfigs = b.config.poolConfigs()
+	}
+	for name, pool := range config.poolConfigs() {
+		previous := oldConfigs[name]
+		if previous == nil || b.pools[name] == nil || pool.Strategy != previous.Strategy ||
+			pool.StrategyOptions() != previous.StrategyOptions() {
+			strategy, err := NewStrategy(pool.Strategy, pool.StrategyOptions())
+			if err != nil {
+				return nil, err
 			}
+			loaded.strategies[name] = strategy
 		}
-		if *traceEnabled {
-			rw.Header().Set("lb-from", dst)
+
+		var tlsConfig *tls.Config
+		var err error
+		if current := b.pools[name]; current != nil {
+			tlsConfig, err = current.buildUpstreamTLS(pool.UpstreamTLS)
+		} else {
+			tlsConfig, err = pool.UpstreamTLS.build()
 		}
-		log.Println("fwd", resp.StatusCode, resp.Request.URL)
-		rw.WriteHeader(resp.StatusCode)
-		defer resp.Body.Close()
-		_, err := io.Copy(rw, resp.Body)
 		if err != nil {
-			log.Printf("Failed to write response: %s", err)
+			return nil, err
+		}
+		loaded.upstreamTLS[name] = tlsConfig
+	}
+
+	certificates, err := b.certificates.read(config.TLS)
+	if err != nil {
+		return nil, err
+	}
+	loaded.certificates = certificates
+	// The log file is opened last, nothing can fail after it.
+	if loaded.logFile, err = b.accessLog.open(config.AccessLog); err != nil {
+		return nil, err
+	}
+	return loaded, nil
+}
+
+// configurePools applies the pool configs of config to the pools, creating
+// the pools new in config and stopping the ones no longer in it.
+func (b *Balancer) configurePools(config *Config, loaded *loadedConfig) {
+	configs := config.poolConfigs()
+	pools := make(map[string]*Pool, len(configs))
+	for name, config := range configs {
+		pool, ok := b.pools[name]
+		if !ok {
+			pool = NewPool(loaded.strategies[name])
+			log.Printf("Pool %s added", name)
+		} else if loaded.strategies[name] != nil {
+			pool.SetStrategy(loaded.strategies[name])
+		}
+		pools[name] = pool
+		pool.setUpstreamTLS(config.UpstreamTLS, loaded.upstreamTLS[name])
+		configurePool(pool, config)
+	}
+
+	b.routes.configure(config.Routes, pools)
+	for name, pool := range b.pools {
+		if pools[name] == nil {
+			pool.Stop()
+			log.Printf("Pool %s removed", name)
 		}
-		return nil
-	} else {
-		log.Printf("Failed to get response from %s: %s", dst, err)
-		rw.WriteHeader(http.StatusServiceUnavailable)
-		return err
 	}
+	if b.pool == nil {
+		b.pool = pools[defaultPool]
+	}
+	b.pools = pools
 }
 
-func hash64(s string) uint64 {
-	h := fnv.New64a()
-	h.Write([]byte(s))
-	return h.Sum64()
+// configurePool applies everything but the strategy and the upstream TLS
+// settings from config to pool.
+func configurePool(pool *Pool, config *PoolConfig) {
+	pool.SetTransport(config.Transport)
+	pool.SetOutlierDetection(config.OutlierDetection)
+	pool.SetCircuitBreaker(config.CircuitBreaker)
+	pool.SetRetry(config.Retry)
+	pool.SetUpgrade(config.Upgrade)
+	pool.SetStreaming(config.Streaming)
+	pool.SetSticky(config.Sticky)
+	pool.SetSlowStart(config.SlowStart)
+	pool.Update(config.Backends)
 }
 
-func chooseServer(serversPool []Server, url *url.URL) (*uint64, error) {
-	index := hash64(url.Path) % uint64(len(serversPool))
-	for i := 0; i < len(serversPool) && !serversPool[index].IsAlive; i++ {
-		index = (index + 1) % uint64(len(serversPool))
+// update applies a modified copy of the current config.
+func (b *Balancer) update(modify func(config *Config) error) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	config := *b.config
+	config.Backends = append([]BackendConfig(nil), b.config.Backends...)
+	if b.config.Pools != nil {
+		// Normalizing writes the pools back to the map.
+		config.Pools = make(map[string]PoolConfig, len(b.config.Pools))
+		for name, pool := range b.config.Pools {
+			config.Pools[name] = pool
+		}
 	}
-	if serversPool[index].IsAlive {
-		return &index, nil
-	} else {
-		return nil, fmt.Errorf("balancer: no alive servers found")
+	if err := modify(&config); err != nil {
+		return err
+	}
+	if err := config.normalize(); err != nil {
+		return err
 	}
+	return b.applyLocked(&config)
+}
+
+func (b *Balancer) AddBackend(backend BackendConfig) error {
+	return b.update(func(config *Config) error {
+		config.Backends = append(config.Backends, backend)
+		return nil
+	})
+}
+
+func (b *Balancer) RemoveBackend(address string) error {
+	return b.update(func(config *Config) error {
+		for i := range config.Backends {
+			if config.Backends[i].Address == address {
+				config.Backends = append(config.Backends[:i], config.Backends[i+1:]...)
+				return nil
+			}
+		}
+		return errUnknownBackend
+	})
+}
+
+func (b *Balancer) SetStrategy(name string) error {
+	return b.update(func(config *Config) error {
+		config.Strategy = name
+		return nil
+	})
 }
 
 func main() {
 	flag.Parse()
+	timeout = time.Duration(*timeoutSec) * time.Second
 
-	for i := range serversPool {
-		go func(i int) {
-			for range time.Tick(10 * time.Second) {
-				serversPool[i].IsAlive = health(serversPool[i].Name)
-			}
-		}(i)
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Failed to load config: %s", err)
+	}
+	balancer, err := NewBalancer(config)
+	if err != nil {
+		log.Fatalf("Failed to load config: %s", err)
 	}
 
-	frontend := httptools.CreateServer(*port, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		index, err := chooseServer(serversPool, r.URL)
-		if err != nil {
-			rw.WriteHeader(http.StatusServiceUnavailable)
-			rw.Write([]byte(err.Error()))
-			return
+	if *configPath != "" {
+		reload := func() {
+			config, err := loadConfig()
+			if err == nil {
+				err = balancer.Apply(config)
+			}
+			if err != nil {
+				log.Printf("Failed to reload config: %s", err)
+				return
+			}
+			log.Printf("Config reloaded from %s", *configPath)
 		}
-		forward(serversPool[*index].Name, rw, r)
-	}))
+		signal.OnHangup(reload)
+		go watchConfig(*configPath, time.Duration(*configPollSec)*time.Second, reload)
+	}
+
+	handler := &proxy{
+		pool:      balancer.pool,
+		routes:    balancer.routes,
+		accessLog: balancer.accessLog,
+		forwarder: balancer.forwarder,
+		limiter:   balancer.limiter,
+	}
+	// The write timeout depends on the path, the proxy sets it per request.
+	options := []httptools.Option{httptools.NoWriteTimeout(), httptools.ConnContext(withClientConn)}
+	if config.TLS.Enabled() {
+		options = append(options, httptools.TLS(balancer.certificates.tlsConfig()))
+	}
+	frontend := httptools.CreateServer(*port, handler, options...)
 
 	log.Println("Starting load balancer...")
 	log.Printf("Tracing support enabled: %t", *traceEnabled)
 	frontend.Start()
+	servers := []httptools.Server{frontend}
+	if *adminPort != 0 {
+		log.Printf("Starting admin API on port %d...", *adminPort)
+		admin := httptools.CreateServer(*adminPort, newAdminRouter(balancer).Handler())
+		admin.Start()
+		servers = append(servers, admin)
+	}
+	if *redirectPort != 0 {
+		if config.TLS.Enabled() {
+			log.Printf("Redirecting HTTP requests on port %d to HTTPS...", *redirectPort)
+			redirect := httptools.CreateServer(*redirectPort, redirectToHTTPS(*port))
+			redirect.Start()
+			servers = append(servers, redirect)
+		} else {
+			log.Printf("TLS is not configured, not redirecting HTTP requests on port %d", *redirectPort)
+		}
+	}
 	signal.WaitForTerminationSignal()
+	httptools.ShutdownAll(time.Duration(*shutdownTimeoutSec)*time.Second, servers...)
+	balancer.Stop()
+	if err := balancer.accessLog.Close(); err != nil {
+		log.Printf("Failed to close access log: %s", err)
+	}
 }
@@ -2,6 +2,8 @@ package main
 
 import (
 	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"gopkg.in/check.v1"
@@ -77,3 +79,50 @@ func (s *BalancerSuite) TestBalancer2(c *check.C) {
 	c.Assert(err, check.ErrorMatches, "balancer: no alive servers found")
 	c.Check(index0, check.IsNil)
 }
+
+func (s *BalancerSuite) TestFailedReload(c *check.C) {
+	dir := c.MkDir()
+	config := &Config{
+		PoolConfig: PoolConfig{Backends: []BackendConfig{{Address: "server1:8080"}}},
+		Pools: map[string]PoolConfig{
+			"db": {Backends: []BackendConfig{{Address: "db1:8080"}}},
+		},
+		Routes:    []RouteConfig{{PathPrefix: "/db/", Pool: "db"}},
+		AccessLog: AccessLogConfig{Path: filepath.Join(dir, "access.log")},
+		RateLimit: RateLimitConfig{Rules: []RateLimitRule{{Rate: 10}}},
+	}
+	c.Assert(config.normalize(), check.IsNil)
+	balancer, err := NewBalancer(config)
+	c.Assert(err, check.IsNil)
+	defer balancer.Stop()
+	defer balancer.accessLog.Close()
+	db := balancer.Pools()["db"]
+
+	// The CA bundle of the new pool is missing, so nothing of the config
+	// may be applied.
+	broken := &Config{
+		PoolConfig: PoolConfig{Backends: []BackendConfig{{Address: "server2:8080"}}},
+		Pools: map[string]PoolConfig{
+			"db":  {Backends: []BackendConfig{{Address: "db2:8080"}}},
+			"api": {UpstreamTLS: UpstreamTLSConfig{CAFile: filepath.Join(dir, "missing.pem")}},
+		},
+		Routes:    []RouteConfig{{PathPrefix: "/api/", Pool: "api"}},
+		AccessLog: AccessLogConfig{Path: filepath.Join(dir, "other.log")},
+	}
+	c.Assert(broken.normalize(), check.IsNil)
+	c.Check(balancer.Apply(broken), check.ErrorMatches, "failed to read CA bundle: .*")
+
+	c.Check(balancer.Config(), check.Equals, config)
+	c.Check(balancer.Pools(), check.HasLen, 2)
+	c.Check(balancer.pool.Servers()[0].Name, check.Equals, "server1:8080")
+	c.Check(db.Servers()[0].Name, check.Equals, "db1:8080")
+	c.Check(balancer.accessLog.config.Path, check.Equals, config.AccessLog.Path)
+	_, err = os.Stat(broken.AccessLog.Path)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+	c.Check(balancer.limiter.config.Rules, check.HasLen, 1)
+
+	// Changes through the admin API start from the config still in place.
+	c.Assert(balancer.AddBackend(BackendConfig{Address: "server3:8080"}), check.IsNil)
+	c.Check(balancer.Config().Backends, check.HasLen, 2)
+	c.Check(balancer.Pools(), check.HasLen, 2)
+}
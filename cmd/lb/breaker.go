@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const breakerBuckets = 10
+
+// minBreakerWindow gives every bucket of the window at least a millisecond.
+const minBreakerWindow = breakerBuckets * time.Millisecond
+
+// BreakerConfig controls the circuit breakers of backends. A closed breaker
+// opens when, over the last Window, at least MinRequests were forwarded and
+// ErrorPercent of them failed or SlowPercent of them took longer than
+// SlowDuration. An open breaker lets no requests through for OpenDuration,
+// then turns half-open and lets HalfOpenRequests trial requests through: it
+// closes if all of them succeed and opens again on the first failure, or if
+// they do not all succeed within HalfOpenTimeout, OpenDuration by default.
+type BreakerConfig struct {
+	Disabled         bool     `json:"disabled"`
+	Window           Duration `json:"window"`
+	MinRequests      int      `json:"minRequests"`
+	ErrorPercent     int      `json:"errorPercent"`
+	SlowPercent      int      `json:"slowPercent"`
+	SlowDuration     Duration `json:"slowDuration"`
+	OpenDuration     Duration `json:"openDuration"`
+	HalfOpenRequests int      `json:"halfOpenRequests"`
+	HalfOpenTimeout  Duration `json:"halfOpenTimeout"`
+}
+
+func (c *BreakerConfig) normalize() error {
+	if c.Window < 0 || c.MinRequests < 0 || c.SlowDuration < 0 || c.OpenDuration < 0 ||
+		c.HalfOpenRequests < 0 || c.HalfOpenTimeout < 0 {
+		return fmt.Errorf("circuit breaker settings can not be negative")
+	}
+	if c.ErrorPercent < 0 || c.ErrorPercent > 100 || c.SlowPercent < 0 || c.SlowPercent > 100 {
+		return fmt.Errorf("circuit breaker percents must be between 0 and 100")
+	}
+	if c.Window == 0 {
+		c.Window = Duration(10 * time.Second)
+	}
+	if time.Duration(c.Window) < minBreakerWindow {
+		return fmt.Errorf("circuit breaker window must be at least %s", minBreakerWindow)
+	}
+	if c.MinRequests == 0 {
+		c.MinRequests = 20
+	}
+	if c.ErrorPercent == 0 {
+		c.ErrorPercent = 50
+	}
+	if c.SlowPercent == 0 {
+		c.SlowPercent = 50
+	}
+	if c.SlowDuration == 0 {
+		c.SlowDuration = Duration(2 * time.Second)
+	}
+	if c.OpenDuration == 0 {
+		c.OpenDuration = Duration(30 * time.Second)
+	}
+	if c.HalfOpenRequests == 0 {
+		c.HalfOpenRequests = 3
+	}
+	if c.HalfOpenTimeout == 0 {
+		c.HalfOpenTimeout = c.OpenDuration
+	}
+	return nil
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+type breakerBucket struct {
+	epoch    int64
+	total    int
+	failures int
+	slow     int
+}
+
+// circuitBreaker is the breaker of a single backend. Its zero value lets
+// all requests through until it is configured.
+type circuitBreaker struct {
+	name string
+
+	mutex     sync.Mutex
+	config    BreakerConfig
+	state     breakerState
+	since     time.Time
+	buckets   [breakerBuckets]breakerBucket
+	trials    int
+	successes int
+}
+
+// off reports whether the breaker is disabled or was never configured.
+func (b *circuitBreaker) off() bool {
+	return b.config.Disabled || b.config.Window == 0
+}
+
+func (b *circuitBreaker) configure(config BreakerConfig) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if config != b.config {
+		b.config = config
+		b.setState(breakerClosed, time.Now())
+	}
+}
+
+func (b *circuitBreaker) setState(state breakerState, now time.Time) {
+	if state != b.state {
+		log.Printf("Circuit breaker of backend %s is %s", b.name, state)
+	}
+	b.state = state
+	b.buckets = [breakerBuckets]breakerBucket{}
+	b.trials = 0
+	b.successes = 0
+	b.since = now
+}
+
+// current returns the state of the breaker and whether it lets a request
+// through now.
+func (b *circuitBreaker) current(now time.Time) (breakerState, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.off() {
+		return breakerClosed, true
+	}
+	b.advance(now)
+	switch b.state {
+	case breakerOpen:
+		return b.state, false
+	case breakerHalfOpen:
+		return b.state, b.trials < b.config.HalfOpenRequests
+	}
+	return b.state, true
+}
+
+func (b *circuitBreaker) advance(now time.Time) {
+	switch {
+	case b.state == breakerOpen && now.Sub(b.since) >= time.Duration(b.config.OpenDuration):
+		b.setState(breakerHalfOpen, now)
+	case b.state == breakerHalfOpen && now.Sub(b.since) >= time.Duration(b.config.HalfOpenTimeout):
+		// The trials should have been recorded or released by now, do not
+		// wait for the lost ones forever.
+		log.Printf("Circuit breaker of backend %s timed out waiting for trial requests", b.name)
+		b.setState(breakerOpen, now)
+	}
+}
+
+// acquire takes a trial request of a half-open breaker. It reports false if
+// the breaker does not let a request through anymore.
+func (b *circuitBreaker) acquire(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.off() {
+		return true
+	}
+	b.advance(now)
+	switch b.state {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		if b.trials >= b.config.HalfOpenRequests {
+			return false
+		}
+		b.trials++
+	}
+	return true
+}
+
+// release gives back a trial request taken by acquire that was not sent.
+func (b *circuitBreaker) release() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state == breakerHalfOpen && b.trials > b.successes {
+		b.trials--
+	}
+}
+
+// cancel records a request the client gave up on before the backend
+// answered. It does not count against a closed breaker, but a half-open one
+// can not tell from it whether the backend recovered, so it opens again.
+func (b *circuitBreaker) cancel(now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.off() {
+		return
+	}
+	b.advance(now)
+	if b.state == breakerHalfOpen {
+		b.setState(breakerOpen, now)
+	}
+}
+
+func (b *circuitBreaker) record(now time.Time, failed bool, latency time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.off() {
+		return
+	}
+	slow := latency >= time.Duration(b.config.SlowDuration)
+
+	switch b.state {
+	case breakerHalfOpen:
+		if failed || slow {
+			b.setState(breakerOpen, now)
+			return
+		}
+		b.successes++
+		if b.successes >= b.config.HalfOpenRequests {
+			b.setState(breakerClosed, now)
+		}
+	case breakerClosed:
+		bucketSize := int64(b.config.Window) / breakerBuckets
+		epoch := now.UnixNano() / bucketSize
+		bucket := &b.buckets[epoch%breakerBuckets]
+		if bucket.epoch != epoch {
+			*bucket = breakerBucket{epoch: epoch}
+		}
+		bucket.total++
+		if failed {
+			bucket.failures++
+		}
+		if slow {
+			bucket.slow++
+		}
+
+		var total, failures, slowCalls int
+		for _, bucket := range b.buckets {
+			if epoch-bucket.epoch < breakerBuckets {
+				total += bucket.total
+				failures += bucket.failures
+				slowCalls += bucket.slow
+			}
+		}
+		if total >= b.config.MinRequests &&
+			(failures*100 >= total*b.config.ErrorPercent || slowCalls*100 >= total*b.config.SlowPercent) {
+			b.setState(breakerOpen, now)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type BreakerSuite struct{}
+
+var _ = check.Suite(&BreakerSuite{})
+
+func testBreaker(c *check.C, config BreakerConfig) *circuitBreaker {
+	c.Assert(config.normalize(), check.IsNil)
+	b := &circuitBreaker{name: "a:8080"}
+	b.configure(config)
+	return b
+}
+
+func (s *BreakerSuite) TestNormalize(c *check.C) {
+	config := BreakerConfig{}
+	c.Assert(config.normalize(), check.IsNil)
+	c.Check(config.Window, check.Equals, Duration(10*time.Second))
+
+	config = BreakerConfig{Window: Duration(5 * time.Nanosecond)}
+	c.Check(config.normalize(), check.ErrorMatches, "circuit breaker window must be at least 10ms")
+	config = BreakerConfig{Window: Duration(minBreakerWindow)}
+	c.Check(config.normalize(), check.IsNil)
+}
+
+func (s *BreakerSuite) TestErrorRate(c *check.C) {
+	b := testBreaker(c, BreakerConfig{MinRequests: 10, ErrorPercent: 50})
+	now := time.Now()
+	for i := 0; i < 9; i++ {
+		b.record(now, true, 0)
+	}
+	state, allowed := b.current(now)
+	c.Check(state, check.Equals, breakerClosed)
+	c.Check(allowed, check.Equals, true)
+
+	b.record(now, false, 0)
+	state, allowed = b.current(now)
+	c.Check(state, check.Equals, breakerOpen)
+	c.Check(allowed, check.Equals, false)
+	c.Check(b.acquire(now), check.Equals, false)
+}
+
+func (s *BreakerSuite) TestRollingWindow(c *check.C) {
+	b := testBreaker(c, BreakerConfig{Window: Duration(10 * time.Second), MinRequests: 10})
+	now := time.Now()
+	for i := 0; i < 9; i++ {
+		b.record(now, true, 0)
+	}
+	// The old failures left the window, so one more does not open the breaker.
+	b.record(now.Add(11*time.Second), true, 0)
+	state, _ := b.current(now)
+	c.Check(state, check.Equals, breakerClosed)
+}
+
+func (s *BreakerSuite) TestLatency(c *check.C) {
+	b := testBreaker(c, BreakerConfig{MinRequests: 4, SlowPercent: 50, SlowDuration: Duration(time.Second)})
+	now := time.Now()
+	b.record(now, false, 10*time.Millisecond)
+	b.record(now, false, 10*time.Millisecond)
+	b.record(now, false, 2*time.Second)
+	b.record(now, false, 3*time.Second)
+	state, _ := b.current(now)
+	c.Check(state, check.Equals, breakerOpen)
+}
+
+func (s *BreakerSuite) TestHalfOpen(c *check.C) {
+	b := testBreaker(c, BreakerConfig{MinRequests: 1, OpenDuration: Duration(time.Second), HalfOpenRequests: 2})
+	now := time.Now()
+	b.record(now, true, 0)
+
+	later := now.Add(time.Second)
+	state, allowed := b.current(later)
+	c.Check(state, check.Equals, breakerHalfOpen)
+	c.Check(allowed, check.Equals, true)
+	c.Check(b.acquire(later), check.Equals, true)
+	c.Check(b.acquire(later), check.Equals, true)
+	c.Check(b.acquire(later), check.Equals, false)
+	_, allowed = b.current(later)
+	c.Check(allowed, check.Equals, false)
+
+	// A failed trial opens the breaker again.
+	b.record(later, true, 0)
+	state, _ = b.current(later)
+	c.Check(state, check.Equals, breakerOpen)
+
+	// Successful trials close it.
+	later = later.Add(time.Second)
+	c.Check(b.acquire(later), check.Equals, true)
+	b.record(later, false, 0)
+	c.Check(b.acquire(later), check.Equals, true)
+	b.record(later, false, 0)
+	state, allowed = b.current(later)
+	c.Check(state, check.Equals, breakerClosed)
+	c.Check(allowed, check.Equals, true)
+}
+
+func (s *BreakerSuite) TestLostTrials(c *check.C) {
+	b := testBreaker(c, BreakerConfig{MinRequests: 1, OpenDuration: Duration(time.Second), HalfOpenRequests: 1})
+	now := time.Now()
+	b.record(now, true, 0)
+
+	// A trial that was not sent is given back.
+	later := now.Add(time.Second)
+	c.Check(b.acquire(later), check.Equals, true)
+	b.release()
+	c.Check(b.acquire(later), check.Equals, true)
+
+	// A cancelled trial counts as a failed one.
+	b.cancel(later)
+	state, _ := b.current(later)
+	c.Check(state, check.Equals, breakerOpen)
+
+	// Trials that are never recorded open the breaker again after the
+	// half-open timeout.
+	later = later.Add(time.Second)
+	c.Check(b.acquire(later), check.Equals, true)
+	state, allowed := b.current(later.Add(time.Second - time.Millisecond))
+	c.Check(state, check.Equals, breakerHalfOpen)
+	c.Check(allowed, check.Equals, false)
+	state, _ = b.current(later.Add(time.Second))
+	c.Check(state, check.Equals, breakerOpen)
+	c.Check(b.acquire(later.Add(2*time.Second)), check.Equals, true)
+}
+
+func (s *BreakerSuite) TestCancelledTrialRequest(c *check.C) {
+	backend, address := testBackend(c, "backend", 0)
+	defer backend.Close()
+	pool := testPool(c, &roundRobin{}, address)
+	defer pool.Stop()
+	config := BreakerConfig{MinRequests: 1, OpenDuration: Duration(10 * time.Millisecond), HalfOpenRequests: 1}
+	c.Assert(config.normalize(), check.IsNil)
+	pool.SetCircuitBreaker(config)
+	pool.backends[0].breaker.record(time.Now(), true, 0)
+	waitFor(c, func() bool { return pool.Servers()[0].Breaker == "half-open" })
+
+	handler := &proxy{pool: pool}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	c.Check(rw.Code, check.Equals, http.StatusServiceUnavailable)
+
+	// The trial of the cancelled request was given back, so the next one
+	// reaches the backend and closes the breaker.
+	rw = serve(handler, "GET", "/", "")
+	c.Check(rw.Code, check.Equals, http.StatusOK)
+	c.Check(pool.Servers()[0].Breaker, check.Equals, "closed")
+}
+
+func (s *BreakerSuite) TestProxySkipsOpenBreaker(c *check.C) {
+	failing, failingAddress := testBackend(c, "failing", http.StatusInternalServerError)
+	defer failing.Close()
+	good, goodAddress := testBackend(c, "good", 0)
+	defer good.Close()
+
+	pool := testPool(c, &roundRobin{}, failingAddress, goodAddress)
+	defer pool.Stop()
+	config := BreakerConfig{MinRequests: 2}
+	c.Assert(config.normalize(), check.IsNil)
+	pool.SetCircuitBreaker(config)
+
+	handler := &proxy{pool: pool}
+	for i := 0; i < 4; i++ {
+		serve(handler, "POST", "/", "")
+	}
+	c.Check(pool.Servers()[0].Breaker, check.Equals, "open")
+	for i := 0; i < 4; i++ {
+		rw := serve(handler, "POST", "/", "")
+		c.Check(rw.Code, check.Equals, http.StatusOK)
+	}
+
+	*traceEnabled = true
+	defer func() { *traceEnabled = false }()
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	c.Check(rw.Header().Get("lb-breaker"), check.Equals, "closed")
+}
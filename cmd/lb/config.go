@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Duration is a time.Duration that is written in JSON either as a string
+// like "1m30s" or as a number of seconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case float64:
+		*d = Duration(v * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s", data)
+	}
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+type BackendConfig struct {
+	Address string `json:"address"`
+	Weight  int    `json:"weight"`
+	Scheme  string `json:"scheme"`
+	// HealthPath is a shorthand for HealthCheck.Path.
+	HealthPath  string             `json:"healthPath"`
+	HealthCheck *HealthCheckConfig `json:"healthCheck"`
+}
+
+// PoolConfig is the config of a pool of backends and the way requests are
+// balanced between them.
+type PoolConfig struct {
+	Strategy     string `json:"strategy"`
+	VirtualNodes int    `json:"virtualNodes"`
+	HashKey      string `json:"hashKey"`
+	// HealthCheck holds the defaults for the health checks of all backends.
+	HealthCheck      HealthCheckConfig `json:"healthCheck"`
+	OutlierDetection OutlierConfig     `json:"outlierDetection"`
+	CircuitBreaker   BreakerConfig     `json:"circuitBreaker"`
+	Retry            RetryConfig       `json:"retry"`
+	Upgrade          UpgradeConfig     `json:"upgrade"`
+	Streaming        StreamingConfig   `json:"streaming"`
+	Sticky           StickyConfig      `json:"sticky"`
+	SlowStart        SlowStartConfig   `json:"slowStart"`
+	UpstreamTLS      UpstreamTLSConfig `json:"upstreamTls"`
+	Transport        TransportConfig   `json:"transport"`
+	Backends         []BackendConfig   `json:"backends"`
+}
+
+// Config is the config of the balancer. Its own pool is the default one,
+// getting the requests no route matches; Pools are the other pools routes
+// refer to by name.
+type Config struct {
+	PoolConfig
+	Pools      map[string]PoolConfig `json:"pools"`
+	Routes     []RouteConfig         `json:"routes"`
+	AccessLog  AccessLogConfig       `json:"accessLog"`
+	Forwarding ForwardingConfig      `json:"forwarding"`
+	RateLimit  RateLimitConfig       `json:"rateLimit"`
+	TLS        TLSConfig             `json:"tls"`
+}
+
+func defaultConfig() *Config {
+	config := &Config{PoolConfig: PoolConfig{
+		Backends: []BackendConfig{
+			{Address: "server1:8080"},
+			{Address: "server2:8080"},
+			{Address: "server3:8080"},
+		},
+	}}
+	_ = config.normalize()
+	return config
+}
+
+func LoadConfig(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	config := &Config{}
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("config: can not decode %s: %s", path, err)
+	}
+	if err := config.normalize(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *Config) normalize() error {
+	if err := c.PoolConfig.normalize(); err != nil {
+		return fmt.Errorf("config: %s", err)
+	}
+	for name, pool := range c.Pools {
+		if name == "" || name == defaultPool {
+			return fmt.Errorf("config: pool name %q is reserved", name)
+		}
+		if err := pool.normalize(); err != nil {
+			return fmt.Errorf("config: pool %s: %s", name, err)
+		}
+		c.Pools[name] = pool
+	}
+	for i := range c.Routes {
+		if err := c.Routes[i].normalize(); err != nil {
+			return fmt.Errorf("config: route %d: %s", i, err)
+		}
+		if _, ok := c.Pools[c.Routes[i].Pool]; !ok && c.Routes[i].Pool != defaultPool {
+			return fmt.Errorf("config: route %d: unknown pool %s", i, c.Routes[i].Pool)
+		}
+	}
+	if err := c.AccessLog.normalize(); err != nil {
+		return fmt.Errorf("config: %s", err)
+	}
+	if err := c.Forwarding.normalize(); err != nil {
+		return fmt.Errorf("config: %s", err)
+	}
+	if err := c.RateLimit.normalize(); err != nil {
+		return fmt.Errorf("config: %s", err)
+	}
+	if err := c.TLS.normalize(); err != nil {
+		return fmt.Errorf("config: %s", err)
+	}
+	return nil
+}
+
+func (c *PoolConfig) normalize() error {
+	if _, err := NewStrategy(c.Strategy, c.StrategyOptions()); err != nil {
+		return err
+	}
+	if c.VirtualNodes < 0 {
+		return fmt.Errorf("negative number of virtual nodes")
+	}
+	if c.VirtualNodes == 0 {
+		c.VirtualNodes = defaultVirtualNodes
+	}
+	c.HealthCheck = c.HealthCheck.merge(defaultHealthCheck())
+	if err := c.HealthCheck.validate(); err != nil {
+		return err
+	}
+	if err := c.OutlierDetection.normalize(); err != nil {
+		return err
+	}
+	if err := c.CircuitBreaker.normalize(); err != nil {
+		return err
+	}
+	if err := c.Retry.normalize(); err != nil {
+		return err
+	}
+	if err := c.Streaming.normalize(); err != nil {
+		return err
+	}
+	if err := c.Sticky.normalize(); err != nil {
+		return err
+	}
+	if err := c.SlowStart.normalize(); err != nil {
+		return err
+	}
+	if err := c.Upgrade.normalize(); err != nil {
+		return err
+	}
+	if err := c.UpstreamTLS.normalize(); err != nil {
+		return err
+	}
+	if err := c.Transport.normalize(); err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for i := range c.Backends {
+		b := &c.Backends[i]
+		if b.Address == "" {
+			return fmt.Errorf("backend %d has no address", i)
+		}
+		if seen[b.Address] {
+			return fmt.Errorf("duplicate backend %s", b.Address)
+		}
+		seen[b.Address] = true
+
+		if b.Weight < 0 {
+			return fmt.Errorf("backend %s has negative weight", b.Address)
+		}
+		if b.Weight == 0 {
+			b.Weight = 1
+		}
+		if b.Scheme == "" {
+			b.Scheme = scheme()
+		}
+		if b.Scheme != "http" && b.Scheme != "https" {
+			return fmt.Errorf("backend %s has unsupported scheme %s", b.Address, b.Scheme)
+		}
+		check := HealthCheckConfig{Path: b.HealthPath}
+		if b.HealthCheck != nil {
+			check = *b.HealthCheck
+			if b.HealthPath != "" {
+				check.Path = b.HealthPath
+			}
+		}
+		check = check.merge(c.HealthCheck)
+		if err := check.validate(); err != nil {
+			return fmt.Errorf("backend %s: %s", b.Address, err)
+		}
+		b.HealthCheck = &check
+		b.HealthPath = check.Path
+	}
+	return nil
+}
+
+// poolConfigs returns the configs of all pools by name, including the
+// default one.
+func (c *Config) poolConfigs() map[string]*PoolConfig {
+	configs := map[string]*PoolConfig{defaultPool: &c.PoolConfig}
+	for name, pool := range c.Pools {
+		pool := pool
+		configs[name] = &pool
+	}
+	return configs
+}
+
+func (c *PoolConfig) StrategyOptions() StrategyOptions {
+	return StrategyOptions{VirtualNodes: c.VirtualNodes, HashKey: c.HashKey}
+}
+
+// watchConfig polls the file at path and calls onChange every time its
+// modification time or size changes.
+func watchConfig(path string, interval time.Duration, onChange func()) {
+	var lastMod time.Time
+	var lastSize int64
+	if info, err := os.Stat(path); err == nil {
+		lastMod, lastSize = info.ModTime(), info.Size()
+	}
+	for range time.Tick(interval) {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(lastMod) || info.Size() != lastSize {
+			lastMod, lastSize = info.ModTime(), info.Size()
+			onChange()
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type ConfigSuite struct{}
+
+var _ = check.Suite(&ConfigSuite{})
+
+func writeConfig(c *check.C, content string) string {
+	path := filepath.Join(c.MkDir(), "lb.json")
+	err := ioutil.WriteFile(path, []byte(content), 0o600)
+	c.Assert(err, check.IsNil)
+	return path
+}
+
+func (s *ConfigSuite) TestLoadConfig(c *check.C) {
+	path := writeConfig(c, `{
+		"healthCheck": {"interval": "2s", "fall": 3},
+		"backends": [
+			{"address": "server1:8080"},
+			{"address": "server2:8080", "weight": 3, "scheme": "https", "healthPath": "ping"},
+			{"address": "server3:8080", "healthCheck": {
+				"path": "/ready", "method": "head", "interval": 0.5, "timeout": "100ms",
+				"expectedStatus": [200, 204], "expectedBody": "OK", "rise": 2
+			}}
+		]
+	}`)
+
+	config, err := LoadConfig(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(config.Backends, check.HasLen, 3)
+
+	b := config.Backends[0]
+	c.Check([]interface{}{b.Address, b.Weight, b.Scheme, b.HealthPath}, check.DeepEquals,
+		[]interface{}{"server1:8080", 1, "http", "/health"})
+	c.Check(*b.HealthCheck, check.DeepEquals, HealthCheckConfig{
+		Path:           "/health",
+		Method:         "GET",
+		Interval:       Duration(2 * time.Second),
+		Timeout:        Duration(timeout),
+		ExpectedStatus: []int{200},
+		Rise:           1,
+		Fall:           3,
+	})
+
+	b = config.Backends[1]
+	c.Check([]interface{}{b.Address, b.Weight, b.Scheme, b.HealthPath}, check.DeepEquals,
+		[]interface{}{"server2:8080", 3, "https", "/ping"})
+	c.Check(b.HealthCheck.Path, check.Equals, "/ping")
+
+	b = config.Backends[2]
+	c.Check(b.HealthPath, check.Equals, "/ready")
+	c.Check(*b.HealthCheck, check.DeepEquals, HealthCheckConfig{
+		Path:           "/ready",
+		Method:         "HEAD",
+		Interval:       Duration(500 * time.Millisecond),
+		Timeout:        Duration(100 * time.Millisecond),
+		ExpectedStatus: []int{200, 204},
+		ExpectedBody:   "OK",
+		Rise:           2,
+		Fall:           3,
+	})
+}
+
+func (s *ConfigSuite) TestLoadConfigErrors(c *check.C) {
+	_, err := LoadConfig(writeConfig(c, `{"backends": [{"address": "a:1"}, {"address": "a:1"}]}`))
+	c.Check(err, check.ErrorMatches, "config: duplicate backend a:1")
+
+	_, err = LoadConfig(writeConfig(c, `{"backends": [{"weight": 1}]}`))
+	c.Check(err, check.ErrorMatches, "config: backend 0 has no address")
+
+	_, err = LoadConfig(writeConfig(c, `{"backends": [{"address": "a:1", "scheme": "ftp"}]}`))
+	c.Check(err, check.ErrorMatches, "config: backend a:1 has unsupported scheme ftp")
+
+	_, err = LoadConfig(writeConfig(c, `{"backends": [{"address": "a:1", "healthCheck": {"interval": "soon"}}]}`))
+	c.Check(err, check.NotNil)
+
+	_, err = LoadConfig(writeConfig(c, `{"healthCheck": {"expectedStatus": [42]}}`))
+	c.Check(err, check.ErrorMatches, "config: invalid expected health check status 42")
+
+	_, err = LoadConfig(writeConfig(c, `{"servers": []}`))
+	c.Check(err, check.NotNil)
+
+	_, err = LoadConfig(filepath.Join(c.MkDir(), "missing.json"))
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
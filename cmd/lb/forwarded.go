@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ForwardingConfig controls the headers telling backends about the client
+// and the proxies a request went through: X-Forwarded-For,
+// X-Forwarded-Host, X-Forwarded-Proto, Forwarded and Via. The values the
+// client sent are kept and extended only if it is one of TrustedProxies,
+// addresses or CIDR ranges, otherwise they are replaced. Via names the
+// balancer in the Via header.
+type ForwardingConfig struct {
+	Disabled       bool     `json:"disabled"`
+	TrustedProxies []string `json:"trustedProxies"`
+	Via            string   `json:"via"`
+
+	trusted []*net.IPNet
+}
+
+func (c *ForwardingConfig) normalize() error {
+	c.trusted = make([]*net.IPNet, 0, len(c.TrustedProxies))
+	for _, proxy := range c.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return fmt.Errorf("invalid trusted proxy %s", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			c.trusted = append(c.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %s", proxy)
+		}
+		c.trusted = append(c.trusted, network)
+	}
+	if c.Via == "" {
+		c.Via = "lb"
+	}
+	return nil
+}
+
+func (c *ForwardingConfig) trusts(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range c.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// client finds the address of the client that sent r, skipping the trusted
+// proxies in X-Forwarded-For.
+func (c *ForwardingConfig) client(r *http.Request) string {
+	peer := peerIP(r)
+	if !c.trusts(peer) {
+		return peer
+	}
+	forwarded := headerList(r.Header, "X-Forwarded-For")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		if !c.trusts(forwarded[i]) {
+			return forwarded[i]
+		}
+	}
+	if len(forwarded) > 0 {
+		return forwarded[0]
+	}
+	return peer
+}
+
+// headerList returns the comma separated values of all the key headers.
+func headerList(header http.Header, key string) []string {
+	var list []string
+	for _, line := range header.Values(key) {
+		for _, value := range strings.Split(line, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				list = append(list, value)
+			}
+		}
+	}
+	return list
+}
+
+// forwardedValue quotes value for the Forwarded header unless it is a
+// token.
+func forwardedValue(value string) string {
+	for _, c := range value {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return fmt.Sprintf("%q", value)
+		}
+	}
+	return value
+}
+
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return forwardedValue("[" + ip + "]")
+	}
+	return forwardedValue(ip)
+}
+
+// forwarder sets the forwarding headers of the requests. A nil forwarder
+// leaves them as they are.
+type forwarder struct {
+	mutex  sync.RWMutex
+	config ForwardingConfig
+}
+
+func (f *forwarder) configure(config ForwardingConfig) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.config = config
+}
+
+// rewrite sets the forwarding headers of r and returns it with the address
+// of the client attached, see clientIP.
+func (f *forwarder) rewrite(r *http.Request) *http.Request {
+	if f == nil {
+		return r
+	}
+	f.mutex.RLock()
+	config := f.config
+	f.mutex.RUnlock()
+	if config.Disabled {
+		return r
+	}
+
+	peer := peerIP(r)
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	element := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedNode(peer), forwardedValue(r.Host), proto)
+	if config.trusts(peer) {
+		r.Header.Set("X-Forwarded-For", strings.Join(append(headerList(r.Header, "X-Forwarded-For"), peer), ", "))
+		if r.Header.Get("X-Forwarded-Host") == "" {
+			r.Header.Set("X-Forwarded-Host", r.Host)
+		}
+		if r.Header.Get("X-Forwarded-Proto") == "" {
+			r.Header.Set("X-Forwarded-Proto", proto)
+		}
+		r.Header.Set("Forwarded", strings.Join(append(headerList(r.Header, "Forwarded"), element), ", "))
+	} else {
+		r.Header.Set("X-Forwarded-For", peer)
+		r.Header.Set("X-Forwarded-Host", r.Host)
+		r.Header.Set("X-Forwarded-Proto", proto)
+		r.Header.Set("Forwarded", element)
+	}
+	via := fmt.Sprintf("%d.%d %s", r.ProtoMajor, r.ProtoMinor, config.Via)
+	r.Header.Set("Via", strings.Join(append(headerList(r.Header, "Via"), via), ", "))
+
+	return r.WithContext(context.WithValue(r.Context(), clientKey{}, config.client(r)))
+}
+
+type clientKey struct{}
+
+// peerIP returns the address of the immediate peer that sent r.
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientIP returns the address of the client that sent r, as found by the
+// forwarder, or of the immediate peer if the request was not rewritten.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientKey{}).(string); ok {
+		return ip
+	}
+	return peerIP(r)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"gopkg.in/check.v1"
+)
+
+type ForwardedSuite struct{}
+
+var _ = check.Suite(&ForwardedSuite{})
+
+func testForwarder(c *check.C, trusted ...string) *forwarder {
+	config := ForwardingConfig{TrustedProxies: trusted}
+	c.Assert(config.normalize(), check.IsNil)
+	f := &forwarder{}
+	f.configure(config)
+	return f
+}
+
+func forwardedRequest(remoteAddr string, headers ...string) *http.Request {
+	r := httptest.NewRequest("GET", "http://example.com/path", nil)
+	r.RemoteAddr = remoteAddr
+	for i := 0; i < len(headers); i += 2 {
+		r.Header.Add(headers[i], headers[i+1])
+	}
+	return r
+}
+
+func (s *ForwardedSuite) TestInvalidTrustedProxy(c *check.C) {
+	for _, proxy := range []string{"10.0.0.0/33", "proxy.local", ""} {
+		config := ForwardingConfig{TrustedProxies: []string{proxy}}
+		c.Check(config.normalize(), check.NotNil, check.Commentf("proxy %q", proxy))
+	}
+}
+
+func (s *ForwardedSuite) TestUntrustedPeer(c *check.C) {
+	f := testForwarder(c, "10.0.0.0/8")
+	r := f.rewrite(forwardedRequest("203.0.113.7:5000",
+		"X-Forwarded-For", "1.2.3.4",
+		"X-Forwarded-Host", "evil.com",
+		"Forwarded", "for=1.2.3.4",
+		"Via", "1.0 other"))
+	c.Check(r.Header.Get("X-Forwarded-For"), check.Equals, "203.0.113.7")
+	c.Check(r.Header.Get("X-Forwarded-Host"), check.Equals, "example.com")
+	c.Check(r.Header.Get("X-Forwarded-Proto"), check.Equals, "http")
+	c.Check(r.Header.Get("Forwarded"), check.Equals, "for=203.0.113.7;host=example.com;proto=http")
+	c.Check(r.Header.Get("Via"), check.Equals, "1.0 other, 1.1 lb")
+	c.Check(clientIP(r), check.Equals, "203.0.113.7")
+}
+
+func (s *ForwardedSuite) TestTrustedPeer(c *check.C) {
+	f := testForwarder(c, "10.0.0.0/8", "192.168.1.1")
+	r := f.rewrite(forwardedRequest("10.1.1.1:5000",
+		"X-Forwarded-For", "1.2.3.4, 192.168.1.1",
+		"X-Forwarded-Proto", "https",
+		"Forwarded", `for=1.2.3.4;proto=https`))
+	c.Check(r.Header.Get("X-Forwarded-For"), check.Equals, "1.2.3.4, 192.168.1.1, 10.1.1.1")
+	c.Check(r.Header.Get("X-Forwarded-Host"), check.Equals, "example.com")
+	c.Check(r.Header.Get("X-Forwarded-Proto"), check.Equals, "https")
+	c.Check(r.Header.Get("Forwarded"), check.Equals, "for=1.2.3.4;proto=https, for=10.1.1.1;host=example.com;proto=http")
+	c.Check(clientIP(r), check.Equals, "1.2.3.4")
+}
+
+func (s *ForwardedSuite) TestIPv6(c *check.C) {
+	f := testForwarder(c)
+	r := f.rewrite(forwardedRequest("[2001:db8::1]:5000"))
+	c.Check(r.Header.Get("X-Forwarded-For"), check.Equals, "2001:db8::1")
+	c.Check(r.Header.Get("Forwarded"), check.Equals, `for="[2001:db8::1]";host=example.com;proto=http`)
+}
+
+func (s *ForwardedSuite) TestDisabled(c *check.C) {
+	config := ForwardingConfig{Disabled: true}
+	c.Assert(config.normalize(), check.IsNil)
+	f := &forwarder{}
+	f.configure(config)
+	r := f.rewrite(forwardedRequest("203.0.113.7:5000", "X-Forwarded-For", "1.2.3.4"))
+	c.Check(r.Header.Get("X-Forwarded-For"), check.Equals, "1.2.3.4")
+	c.Check(r.Header.Get("Via"), check.Equals, "")
+}
+
+func (s *ForwardedSuite) TestProxy(c *check.C) {
+	headers := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+	}))
+	defer backend.Close()
+	address := backend.Listener.Addr().String()
+	pool := testPool(c, &roundRobin{}, address)
+	defer pool.Stop()
+
+	handler := &proxy{pool: pool, forwarder: testForwarder(c)}
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, forwardedRequest("203.0.113.7:5000"))
+	c.Check(rw.Code, check.Equals, http.StatusOK)
+	received := <-headers
+	c.Check(received.Get("X-Forwarded-For"), check.Equals, "203.0.113.7")
+	c.Check(received.Get("X-Forwarded-Host"), check.Equals, "example.com")
+	c.Check(received.Get("Via"), check.Equals, "1.1 lb")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const healthBodyLimit = 64 << 10
+
+// HealthCheckConfig describes how a backend is actively probed. A backend is
+// marked alive after Rise consecutive successful probes and dead after Fall
+// consecutive failed ones; the very first probe decides the state at once.
+type HealthCheckConfig struct {
+	Path           string   `json:"path"`
+	Method         string   `json:"method"`
+	Interval       Duration `json:"interval"`
+	Timeout        Duration `json:"timeout"`
+	ExpectedStatus []int    `json:"expectedStatus"`
+	ExpectedBody   string   `json:"expectedBody"`
+	Rise           int      `json:"rise"`
+	Fall           int      `json:"fall"`
+}
+
+func defaultHealthCheck() HealthCheckConfig {
+	return HealthCheckConfig{
+		Path:           "/health",
+		Method:         http.MethodGet,
+		Interval:       Duration(10 * time.Second),
+		Timeout:        Duration(timeout),
+		ExpectedStatus: []int{http.StatusOK},
+		Rise:           1,
+		Fall:           1,
+	}
+}
+
+// merge returns c with its zero fields taken from defaults.
+func (c HealthCheckConfig) merge(defaults HealthCheckConfig) HealthCheckConfig {
+	if c.Path == "" {
+		c.Path = defaults.Path
+	}
+	if c.Method == "" {
+		c.Method = defaults.Method
+	}
+	if c.Interval == 0 {
+		c.Interval = defaults.Interval
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaults.Timeout
+	}
+	if len(c.ExpectedStatus) == 0 {
+		c.ExpectedStatus = defaults.ExpectedStatus
+	}
+	if c.ExpectedBody == "" {
+		c.ExpectedBody = defaults.ExpectedBody
+	}
+	if c.Rise == 0 {
+		c.Rise = defaults.Rise
+	}
+	if c.Fall == 0 {
+		c.Fall = defaults.Fall
+	}
+	return c
+}
+
+func (c *HealthCheckConfig) validate() error {
+	if !strings.HasPrefix(c.Path, "/") {
+		c.Path = "/" + c.Path
+	}
+	c.Method = strings.ToUpper(c.Method)
+	if c.Interval <= 0 || c.Timeout <= 0 {
+		return fmt.Errorf("health check interval and timeout must be positive")
+	}
+	if c.Rise < 0 || c.Fall < 0 {
+		return fmt.Errorf("health check rise and fall must be positive")
+	}
+	for _, status := range c.ExpectedStatus {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("invalid expected health check status %d", status)
+		}
+	}
+	return nil
+}
+
+func (c *HealthCheckConfig) expects(status int) bool {
+	for _, expected := range c.ExpectedStatus {
+		if status == expected {
+			return true
+		}
+	}
+	return false
+}
+
+// Prober runs a single active health check of dst.
+type Prober func(dst Server, check HealthCheckConfig) error
+
+func probe(dst Server, check HealthCheckConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(check.Timeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, check.Method,
+		fmt.Sprintf("%s://%s%s", dst.Scheme, dst.Name, check.Path), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := dst.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if !check.expects(resp.StatusCode) {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if check.ExpectedBody != "" {
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, healthBodyLimit))
+		if err != nil {
+			return err
+		}
+		if !bytes.Contains(body, []byte(check.ExpectedBody)) {
+			return fmt.Errorf("response does not contain %q", check.ExpectedBody)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type HealthSuite struct{}
+
+var _ = check.Suite(&HealthSuite{})
+
+func (s *HealthSuite) TestProbe(c *check.C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			rw.Write([]byte("OK"))
+		case "/ready":
+			c.Check(r.Method, check.Equals, "HEAD")
+			rw.WriteHeader(http.StatusNoContent)
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+		default:
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("FAILURE"))
+		}
+	}))
+	defer backend.Close()
+	address, _ := url.Parse(backend.URL)
+	dst := Server{Name: address.Host, Scheme: "http"}
+
+	healthCheck := func(path string) HealthCheckConfig {
+		return HealthCheckConfig{Path: path}.merge(defaultHealthCheck())
+	}
+
+	c.Check(probe(dst, healthCheck("/health")), check.IsNil)
+	c.Check(probe(dst, healthCheck("/fail")), check.ErrorMatches, "unexpected status 500")
+
+	body := healthCheck("/health")
+	body.ExpectedBody = "OK"
+	c.Check(probe(dst, body), check.IsNil)
+	body.ExpectedBody = "READY"
+	c.Check(probe(dst, body), check.ErrorMatches, `response does not contain "READY"`)
+
+	ready := healthCheck("/ready")
+	ready.Method = "HEAD"
+	ready.ExpectedStatus = []int{200, 204}
+	c.Check(probe(dst, ready), check.IsNil)
+
+	slow := healthCheck("/slow")
+	slow.Timeout = Duration(10 * time.Millisecond)
+	c.Check(probe(dst, slow), check.NotNil)
+}
+
+func (s *HealthSuite) TestRiseFall(c *check.C) {
+	config := testBackendConfig("server1:8080")
+	config.HealthCheck.Rise = 2
+	config.HealthCheck.Fall = 3
+	b := newBackend(config, nil)
+	stop := make(chan struct{})
+	b.stop = stop
+	failure := fmt.Errorf("unexpected status 500")
+
+	// The first probe decides the initial state.
+	b.record(stop, time.Now(), 0, nil)
+	c.Check(b.Snapshot().IsAlive, check.Equals, true)
+
+	for i, alive := range []bool{true, true, false} {
+		b.record(stop, time.Now(), 0, failure)
+		c.Check(b.Snapshot().IsAlive, check.Equals, alive, check.Commentf("failure %d", i))
+	}
+	for i, alive := range []bool{false, true} {
+		b.record(stop, time.Now(), 0, nil)
+		c.Check(b.Snapshot().IsAlive, check.Equals, alive, check.Commentf("success %d", i))
+	}
+	b.record(stop, time.Now(), 0, failure)
+	b.record(stop, time.Now(), 0, nil)
+	c.Check(b.Snapshot().IsAlive, check.Equals, true)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// hopHeaders are the headers that describe a single connection rather than
+// the message, RFC 7230 section 6.1. They are not forwarded in either
+// direction.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers from header, including the
+// ones listed in its Connection header.
+func removeHopHeaders(header http.Header) {
+	for _, name := range headerList(header, "Connection") {
+		header.Del(name)
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// removeClientHopHeaders removes the hop-by-hop headers the client sent
+// with r, before the balancer sets any headers of its own, so the client can
+// not have those removed by naming them in its Connection header. What the
+// proxy still needs of them is put back: an upgrade keeps its Connection
+// and Upgrade headers and TE is kept if it accepts trailers.
+func removeClientHopHeaders(r *http.Request) {
+	upgrade := isUpgrade(r)
+	protocol := r.Header.Get("Upgrade")
+	trailers := acceptsTrailers(r.Header)
+	removeHopHeaders(r.Header)
+	if upgrade {
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", protocol)
+	}
+	if trailers {
+		r.Header.Set("Te", "trailers")
+	}
+}
+
+// acceptsTrailers reports whether the client said it accepts trailers, which
+// has to be passed on to the backend even though TE is a hop-by-hop header.
+func acceptsTrailers(header http.Header) bool {
+	for _, value := range headerList(header, "Te") {
+		if strings.EqualFold(value, "trailers") {
+			return true
+		}
+	}
+	return false
+}
+
+// announceTrailers lists the trailers of resp in the Trailer header of the
+// response, so they can be set after the body is written.
+func announceTrailers(rw http.ResponseWriter, resp *http.Response) {
+	if len(resp.Trailer) == 0 {
+		return
+	}
+	names := make([]string, 0, len(resp.Trailer))
+	for name := range resp.Trailer {
+		names = append(names, name)
+	}
+	rw.Header().Set("Trailer", strings.Join(names, ", "))
+}
+
+// copyTrailers sets the trailers of resp once its body is read. Trailers the
+// backend did not announce are sent with http.TrailerPrefix.
+func copyTrailers(rw http.ResponseWriter, resp *http.Response, announced int) {
+	prefix := ""
+	if len(resp.Trailer) != announced {
+		prefix = http.TrailerPrefix
+	}
+	for name, values := range resp.Trailer {
+		for _, value := range values {
+			rw.Header().Add(prefix+name, value)
+		}
+	}
+}
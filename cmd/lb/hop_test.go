@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type HopSuite struct{}
+
+var _ = check.Suite(&HopSuite{})
+
+func (s *HopSuite) TestRemoveHopHeaders(c *check.C) {
+	header := http.Header{}
+	header.Add("Connection", "keep-alive, X-Secret")
+	header.Add("Keep-Alive", "timeout=5")
+	header.Add("X-Secret", "1")
+	header.Add("Upgrade", "h2c")
+	header.Add("X-Kept", "1")
+	removeHopHeaders(header)
+	c.Check(header, check.DeepEquals, http.Header{"X-Kept": {"1"}})
+}
+
+func (s *HopSuite) TestProxy(c *check.C) {
+	requests := make(chan *http.Request, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		requests <- r
+		rw.Header().Set("Connection", "X-Backend-Hop")
+		rw.Header().Set("X-Backend-Hop", "1")
+		rw.Header().Set("Keep-Alive", "timeout=5")
+		rw.Header().Set("Trailer", "X-Checksum")
+		rw.Header().Set("X-Kept", "1")
+		_, _ = io.WriteString(rw, "body")
+		rw.Header().Set("X-Checksum", "abc")
+		rw.Header().Set(http.TrailerPrefix+"X-Late", "def")
+	}))
+	defer backend.Close()
+	pool := testPool(c, &roundRobin{}, backend.Listener.Addr().String())
+	defer pool.Stop()
+	frontend := httptest.NewServer(&proxy{pool: pool})
+	defer frontend.Close()
+
+	r, err := http.NewRequest("POST", frontend.URL, nil)
+	c.Assert(err, check.IsNil)
+	r.Header.Set("Connection", "X-Client-Hop")
+	r.Header.Set("X-Client-Hop", "1")
+	r.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+	r.Header.Set("Te", "trailers")
+	r.Trailer = http.Header{"X-Request-Sum": nil}
+	r.Body = &trailingBody{Reader: strings.NewReader("data"), trailer: r.Trailer}
+	resp, err := http.DefaultClient.Do(r)
+	c.Assert(err, check.IsNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, check.IsNil)
+	resp.Body.Close()
+
+	received := <-requests
+	c.Check(received.Header.Get("X-Client-Hop"), check.Equals, "")
+	c.Check(received.Header.Get("Proxy-Authorization"), check.Equals, "")
+	c.Check(received.Header.Get("Te"), check.Equals, "trailers")
+	c.Check(received.Trailer.Get("X-Request-Sum"), check.Equals, "123")
+
+	c.Check(string(body), check.Equals, "body")
+	c.Check(resp.Header.Get("X-Backend-Hop"), check.Equals, "")
+	c.Check(resp.Header.Get("Keep-Alive"), check.Equals, "")
+	c.Check(resp.Header.Get("X-Kept"), check.Equals, "1")
+	c.Check(resp.Trailer.Get("X-Checksum"), check.Equals, "abc")
+	c.Check(resp.Trailer.Get("X-Late"), check.Equals, "def")
+}
+
+func (s *HopSuite) TestConnectionCanNotRemoveProxyHeaders(c *check.C) {
+	requests := make(chan *http.Request, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requests <- r
+	}))
+	defer backend.Close()
+	pool := testPool(c, &roundRobin{}, backend.Listener.Addr().String())
+	defer pool.Stop()
+	route := RouteConfig{Rewrite: RewriteConfig{
+		RequestHeaders: HeaderRules{Set: map[string]string{"lb-author": "lb"}},
+	}}
+	c.Assert(route.normalize(), check.IsNil)
+	routes := &routeTable{}
+	routes.configure([]RouteConfig{route}, map[string]*Pool{defaultPool: pool})
+	handler := &proxy{pool: pool, routes: routes, forwarder: testForwarder(c)}
+
+	r := forwardedRequest("192.0.2.1:1234", "Connection", "X-Forwarded-For, Forwarded, Via, X-Request-Id, lb-author, X-Client-Hop",
+		"X-Client-Hop", "1")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	received := <-requests
+	c.Check(received.Header.Get("X-Client-Hop"), check.Equals, "")
+	for _, name := range []string{"X-Forwarded-For", "Forwarded", "Via", "X-Request-Id", "lb-author"} {
+		c.Check(received.Header.Get(name), check.Not(check.Equals), "", check.Commentf(name))
+	}
+}
+
+// trailingBody sets the request trailer once the body is read.
+type trailingBody struct {
+	io.Reader
+	trailer http.Header
+}
+
+func (b *trailingBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF {
+		b.trailer.Set("X-Request-Sum", "123")
+	}
+	return n, err
+}
+
+func (b *trailingBody) Close() error {
+	return nil
+}
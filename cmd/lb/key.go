@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// KeyExpr computes the affinity key hash based strategies use to choose a
+// backend. The expression is a list of alternatives separated by "|", each
+// alternative is a list of components joined by "+":
+//
+//	header:X-Tenant-Id+path | query:key | ip
+//
+// The first alternative with all of its components present in the request
+// gives the key. Supported components are path, host, method, ip,
+// query:<name>, header:<name> and cookie:<name>. If no alternative matches,
+// or the expression is empty, the request path is used.
+type KeyExpr struct {
+	alternatives [][]keyPart
+}
+
+type keyPart struct {
+	source string
+	name   string
+}
+
+var keySources = map[string]bool{
+	"path":   false,
+	"host":   false,
+	"method": false,
+	"ip":     false,
+	"query":  true,
+	"header": true,
+	"cookie": true,
+}
+
+func ParseKeyExpr(expr string) (KeyExpr, error) {
+	var result KeyExpr
+	if strings.TrimSpace(expr) == "" {
+		return result, nil
+	}
+	for _, alternative := range strings.Split(expr, "|") {
+		var parts []keyPart
+		for _, component := range strings.Split(alternative, "+") {
+			component = strings.TrimSpace(component)
+			part := keyPart{source: component}
+			if i := strings.Index(component, ":"); i >= 0 {
+				part = keyPart{source: component[:i], name: component[i+1:]}
+			}
+			named, ok := keySources[part.source]
+			if !ok {
+				return KeyExpr{}, fmt.Errorf("key: unknown component %q in %q", component, expr)
+			}
+			if named && part.name == "" {
+				return KeyExpr{}, fmt.Errorf("key: component %s requires a name in %q", part.source, expr)
+			}
+			if !named && part.name != "" {
+				return KeyExpr{}, fmt.Errorf("key: component %s does not take a name in %q", part.source, expr)
+			}
+			if part.source == "header" {
+				part.name = http.CanonicalHeaderKey(part.name)
+			}
+			parts = append(parts, part)
+		}
+		result.alternatives = append(result.alternatives, parts)
+	}
+	return result, nil
+}
+
+func (e KeyExpr) Key(r *http.Request) string {
+	for _, parts := range e.alternatives {
+		values := make([]string, 0, len(parts))
+		for _, part := range parts {
+			value := part.value(r)
+			if value == "" {
+				break
+			}
+			values = append(values, value)
+		}
+		if len(values) == len(parts) {
+			return strings.Join(values, "\x00")
+		}
+	}
+	return r.URL.Path
+}
+
+func (p keyPart) value(r *http.Request) string {
+	switch p.source {
+	case "path":
+		return r.URL.Path
+	case "host":
+		return r.Host
+	case "method":
+		return r.Method
+	case "ip":
+		return clientIP(r)
+	case "query":
+		return r.URL.Query().Get(p.name)
+	case "header":
+		return r.Header.Get(p.name)
+	case "cookie":
+		cookie, err := r.Cookie(p.name)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	}
+	return ""
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"gopkg.in/check.v1"
+)
+
+type KeySuite struct{}
+
+var _ = check.Suite(&KeySuite{})
+
+func (s *KeySuite) TestKey(c *check.C) {
+	r := httptest.NewRequest("GET", "http://lb/api/v1/some-data/1?key=k1", nil)
+	r.RemoteAddr = "10.0.0.7:5555"
+	r.Header.Set("X-Tenant-Id", "tenant")
+	r.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+
+	for expr, key := range map[string]string{
+		"":                          "/api/v1/some-data/1",
+		"path":                      "/api/v1/some-data/1",
+		"query:key":                 "k1",
+		"header:x-tenant-id":        "tenant",
+		"cookie:session":            "s1",
+		"ip":                        "10.0.0.7",
+		"host + method":             "lb\x00GET",
+		"header:X-Tenant-Id+path":   "tenant\x00/api/v1/some-data/1",
+		"query:missing | query:key": "k1",
+		"query:key+query:missing | cookie:session": "s1",
+		"header:missing | cookie:missing":          "/api/v1/some-data/1",
+	} {
+		parsed, err := ParseKeyExpr(expr)
+		c.Assert(err, check.IsNil, check.Commentf(expr))
+		c.Check(parsed.Key(r), check.Equals, key, check.Commentf(expr))
+	}
+}
+
+func (s *KeySuite) TestParseErrors(c *check.C) {
+	_, err := ParseKeyExpr("body")
+	c.Check(err, check.ErrorMatches, `key: unknown component "body" in "body"`)
+	_, err = ParseKeyExpr("path | header:")
+	c.Check(err, check.ErrorMatches, `key: component header requires a name .*`)
+	_, err = ParseKeyExpr("ip:x")
+	c.Check(err, check.ErrorMatches, `key: component ip does not take a name .*`)
+	_, err = NewStrategy("consistent-hash", StrategyOptions{HashKey: "body"})
+	c.Check(err, check.NotNil)
+}
+
+func (s *KeySuite) TestQueryAffinity(c *check.C) {
+	strategy, err := NewStrategy("consistent-hash", StrategyOptions{HashKey: "query:key"})
+	c.Assert(err, check.IsNil)
+	servers := testServers(true, true, true)
+	first, err := strategy.Pick(httptest.NewRequest("GET", "/a?key=tenant1", nil), servers)
+	c.Assert(err, check.IsNil)
+	for _, path := range []string{"/b?key=tenant1", "/c?key=tenant1&x=1"} {
+		server, err := strategy.Pick(httptest.NewRequest("GET", path, nil), servers)
+		c.Assert(err, check.IsNil)
+		c.Check(server.Name, check.Equals, first.Name)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the request latency histogram in
+// seconds.
+var latencyBuckets = [...]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// statusClasses label the outcomes of forwarded requests: a response of one
+// of the status classes or an error without any response.
+var statusClasses = [...]string{"1xx", "2xx", "3xx", "4xx", "5xx", "error"}
+
+func statusClass(status int, err error) int {
+	if err != nil || status < 100 || status >= 600 {
+		return len(statusClasses) - 1
+	}
+	return status/100 - 1
+}
+
+// backendCounters are the cumulative counters of a backend exposed as
+// metrics.
+type backendCounters struct {
+	Responses [len(statusClasses)]uint64
+	// Latency counts the requests per latency bucket, the last one is for
+	// the requests slower than all the buckets.
+	Latency      [len(latencyBuckets) + 1]uint64
+	LatencySum   time.Duration
+	ChecksPassed uint64
+	ChecksFailed uint64
+	Retries      uint64
+	Ejections    uint64
+	Connections  ConnectionStats
+}
+
+// backendMetrics guards the counters of a backend. They live as long as the
+// backend stays in the pool.
+type backendMetrics struct {
+	mutex    sync.Mutex
+	counters backendCounters
+}
+
+func (m *backendMetrics) snapshot() backendCounters {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.counters
+}
+
+func (m *backendMetrics) request(status int, err error, latency time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.counters.Responses[statusClass(status, err)]++
+	bucket := 0
+	for bucket < len(latencyBuckets) && latency.Seconds() > latencyBuckets[bucket] {
+		bucket++
+	}
+	m.counters.Latency[bucket]++
+	m.counters.LatencySum += latency
+}
+
+func (m *backendMetrics) check(err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err != nil {
+		m.counters.ChecksFailed++
+	} else {
+		m.counters.ChecksPassed++
+	}
+}
+
+func (m *backendMetrics) retry() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.counters.Retries++
+}
+
+func (m *backendMetrics) ejection() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.counters.Ejections++
+}
+
+func (m *backendMetrics) connectionOpened() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.counters.Connections.Open++
+	m.counters.Connections.Opened++
+}
+
+func (m *backendMetrics) connectionClosed() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.counters.Connections.Open--
+}
+
+func (m *backendMetrics) connectionReused() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.counters.Connections.Reused++
+}
+
+func (m *backendMetrics) dialFailure() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.counters.Connections.DialFailures++
+}
+
+// exposition writes metrics in the Prometheus text exposition format.
+type exposition struct {
+	bytes.Buffer
+}
+
+func (e *exposition) family(name, kind, help string) {
+	fmt.Fprintf(e, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a single value, labels are name and value pairs.
+func (e *exposition) sample(name string, value float64, labels ...string) {
+	e.WriteString(name)
+	if len(labels) > 0 {
+		e.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				e.WriteByte(',')
+			}
+			fmt.Fprintf(e, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		e.WriteByte('}')
+	}
+	fmt.Fprintf(e, " %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+type backendSample struct {
+	pool     string
+	server   Server
+	counters backendCounters
+}
+
+// labels returns the labels identifying the backend followed by extra.
+func (s *backendSample) labels(extra ...string) []string {
+	return append([]string{"pool", s.pool, "backend", s.server.Name}, extra...)
+}
+
+// writeMetrics writes the metrics of all backends of pools to e, ordered by
+// the pool names.
+func writeMetrics(e *exposition, pools map[string]*Pool) {
+	names := make([]string, 0, len(pools))
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var samples []backendSample
+	for _, name := range names {
+		pool := pools[name]
+		pool.mutex.RLock()
+		backends := pool.backends
+		pool.mutex.RUnlock()
+		for _, b := range backends {
+			samples = append(samples, backendSample{pool: name, server: b.Snapshot(), counters: b.metrics.snapshot()})
+		}
+	}
+
+	e.family("lb_backend_requests_total", "counter", "Requests forwarded to the backend by response status class.")
+	for _, s := range samples {
+		for class, n := range s.counters.Responses {
+			e.sample("lb_backend_requests_total", float64(n), s.labels("code", statusClasses[class])...)
+		}
+	}
+
+	e.family("lb_backend_request_duration_seconds", "histogram", "Latency of the requests forwarded to the backend.")
+	for _, s := range samples {
+		var count uint64
+		for bucket, le := range latencyBuckets {
+			count += s.counters.Latency[bucket]
+			e.sample("lb_backend_request_duration_seconds_bucket", float64(count),
+				s.labels("le", strconv.FormatFloat(le, 'g', -1, 64))...)
+		}
+		count += s.counters.Latency[len(latencyBuckets)]
+		e.sample("lb_backend_request_duration_seconds_bucket", float64(count), s.labels("le", "+Inf")...)
+		e.sample("lb_backend_request_duration_seconds_sum", s.counters.LatencySum.Seconds(), s.labels()...)
+		e.sample("lb_backend_request_duration_seconds_count", float64(count), s.labels()...)
+	}
+
+	e.family("lb_backend_in_flight_requests", "gauge", "Requests currently forwarded to the backend.")
+	for _, s := range samples {
+		e.sample("lb_backend_in_flight_requests", float64(s.server.ActiveConnections()), s.labels()...)
+	}
+
+	e.family("lb_backend_connections_open", "gauge", "Connections to the backend currently open.")
+	for _, s := range samples {
+		e.sample("lb_backend_connections_open", float64(s.counters.Connections.Open), s.labels()...)
+	}
+
+	e.family("lb_backend_connections_opened_total", "counter", "Connections opened to the backend.")
+	for _, s := range samples {
+		e.sample("lb_backend_connections_opened_total", float64(s.counters.Connections.Opened), s.labels()...)
+	}
+
+	e.family("lb_backend_connections_reused_total", "counter", "Requests sent to the backend over an idle connection.")
+	for _, s := range samples {
+		e.sample("lb_backend_connections_reused_total", float64(s.counters.Connections.Reused), s.labels()...)
+	}
+
+	e.family("lb_backend_dial_failures_total", "counter", "Failed attempts to connect to the backend.")
+	for _, s := range samples {
+		e.sample("lb_backend_dial_failures_total", float64(s.counters.Connections.DialFailures), s.labels()...)
+	}
+
+	e.family("lb_backend_healthy", "gauge", "Whether the backend passes its health checks.")
+	for _, s := range samples {
+		e.sample("lb_backend_healthy", boolValue(s.server.Healthy), s.labels()...)
+	}
+
+	e.family("lb_backend_up", "gauge", "Whether the backend gets new requests.")
+	for _, s := range samples {
+		e.sample("lb_backend_up", boolValue(s.server.IsAlive), s.labels()...)
+	}
+
+	e.family("lb_backend_health_checks_total", "counter", "Health checks of the backend by result.")
+	for _, s := range samples {
+		e.sample("lb_backend_health_checks_total", float64(s.counters.ChecksPassed), s.labels("result", "success")...)
+		e.sample("lb_backend_health_checks_total", float64(s.counters.ChecksFailed), s.labels("result", "failure")...)
+	}
+
+	e.family("lb_backend_retries_total", "counter", "Requests retried on another backend after failing on the backend.")
+	for _, s := range samples {
+		e.sample("lb_backend_retries_total", float64(s.counters.Retries), s.labels()...)
+	}
+
+	e.family("lb_backend_ejections_total", "counter", "Ejections of the backend by outlier detection.")
+	for _, s := range samples {
+		e.sample("lb_backend_ejections_total", float64(s.counters.Ejections), s.labels()...)
+	}
+
+	e.family("lb_backend_ejected", "gauge", "Whether the backend is ejected by outlier detection.")
+	for _, s := range samples {
+		e.sample("lb_backend_ejected", boolValue(s.server.Ejected), s.labels()...)
+	}
+
+	e.family("lb_backend_effective_weight", "gauge", "Weight the backend is balanced by, lowered in its slow start window.")
+	for _, s := range samples {
+		e.sample("lb_backend_effective_weight", s.server.effectiveWeight(), s.labels()...)
+	}
+
+	e.family("lb_backend_circuit_breaker_state", "gauge", "State of the circuit breaker of the backend.")
+	for _, s := range samples {
+		for _, state := range []breakerState{breakerClosed, breakerOpen, breakerHalfOpen} {
+			e.sample("lb_backend_circuit_breaker_state", boolValue(s.server.Breaker == state.String()),
+				s.labels("state", state.String())...)
+		}
+	}
+}
+
+// metricsHandler serves the metrics of the pools returned by pools.
+func metricsHandler(pools func() map[string]*Pool) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		var e exposition
+		writeMetrics(&e, pools())
+		rw.Header().Set("content-type", "text/plain; version=0.0.4; charset=utf-8")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = e.WriteTo(rw)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type MetricsSuite struct{}
+
+var _ = check.Suite(&MetricsSuite{})
+
+func (s *MetricsSuite) TestStatusClass(c *check.C) {
+	c.Check(statusClasses[statusClass(http.StatusOK, nil)], check.Equals, "2xx")
+	c.Check(statusClasses[statusClass(http.StatusNotFound, nil)], check.Equals, "4xx")
+	c.Check(statusClasses[statusClass(0, fmt.Errorf("refused"))], check.Equals, "error")
+}
+
+func (s *MetricsSuite) TestHistogram(c *check.C) {
+	var m backendMetrics
+	m.request(http.StatusOK, nil, 3*time.Millisecond)
+	m.request(http.StatusOK, nil, 10*time.Millisecond)
+	m.request(http.StatusOK, nil, time.Minute)
+	counters := m.snapshot()
+	c.Check(counters.Latency[0], check.Equals, uint64(1))
+	c.Check(counters.Latency[1], check.Equals, uint64(1))
+	c.Check(counters.Latency[len(latencyBuckets)], check.Equals, uint64(1))
+	c.Check(counters.Responses[1], check.Equals, uint64(3))
+}
+
+func (s *MetricsSuite) TestEscapeLabel(c *check.C) {
+	var e exposition
+	e.sample("name", 1.5, "a", `x"y\z`+"\n")
+	c.Check(e.String(), check.Equals, `name{a="x\"y\\z\n"} 1.5`+"\n")
+}
+
+// singlePool returns the pools of a balancer with just the default pool.
+func singlePool(pool *Pool) func() map[string]*Pool {
+	return func() map[string]*Pool { return map[string]*Pool{defaultPool: pool} }
+}
+
+func (s *MetricsSuite) TestEndpoint(c *check.C) {
+	failing, failingAddress := testBackend(c, "failing", http.StatusBadGateway)
+	defer failing.Close()
+	good, goodAddress := testBackend(c, "good", 0)
+	defer good.Close()
+
+	pool := testPool(c, &roundRobin{}, failingAddress, goodAddress)
+	defer pool.Stop()
+	handler := &proxy{pool: pool}
+	for i := 0; i < 2; i++ {
+		c.Check(serve(handler, "GET", "/", "").Code, check.Equals, http.StatusOK)
+	}
+
+	rw := serve(metricsHandler(singlePool(pool)), "GET", "/metrics", "")
+	c.Check(rw.Code, check.Equals, http.StatusOK)
+	c.Check(rw.Header().Get("content-type"), check.Matches, "text/plain; version=0.0.4.*")
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(rw.Body.String(), "\n") {
+		lines[line] = true
+	}
+	for _, line := range []string{
+		"# TYPE lb_backend_requests_total counter",
+		fmt.Sprintf(`lb_backend_requests_total{pool="default",backend="%s",code="5xx"} 2`, failingAddress),
+		fmt.Sprintf(`lb_backend_requests_total{pool="default",backend="%s",code="2xx"} 2`, goodAddress),
+		fmt.Sprintf(`lb_backend_request_duration_seconds_bucket{pool="default",backend="%s",le="+Inf"} 2`, goodAddress),
+		fmt.Sprintf(`lb_backend_request_duration_seconds_count{pool="default",backend="%s"} 2`, goodAddress),
+		fmt.Sprintf(`lb_backend_retries_total{pool="default",backend="%s"} 2`, failingAddress),
+		fmt.Sprintf(`lb_backend_in_flight_requests{pool="default",backend="%s"} 0`, goodAddress),
+		fmt.Sprintf(`lb_backend_healthy{pool="default",backend="%s"} 1`, goodAddress),
+		fmt.Sprintf(`lb_backend_circuit_breaker_state{pool="default",backend="%s",state="closed"} 1`, goodAddress),
+	} {
+		c.Check(lines[line], check.Equals, true, check.Commentf("missing %s", line))
+	}
+}
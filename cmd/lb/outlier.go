@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// OutlierConfig controls passive health checking: a backend that fails
+// ConsecutiveFailures forwarded requests in a row, either with a connection
+// error or a 5xx status, is ejected from balancing. The n-th ejection in a
+// row lasts BaseEjectionTime*2^(n-1), but not longer than MaxEjectionTime.
+// No more than MaxEjectionPercent of the pool is ejected at the same time,
+// though a single backend can always be.
+type OutlierConfig struct {
+	Disabled            bool     `json:"disabled"`
+	ConsecutiveFailures int      `json:"consecutiveFailures"`
+	BaseEjectionTime    Duration `json:"baseEjectionTime"`
+	MaxEjectionTime     Duration `json:"maxEjectionTime"`
+	MaxEjectionPercent  int      `json:"maxEjectionPercent"`
+}
+
+func (c *OutlierConfig) normalize() error {
+	if c.ConsecutiveFailures < 0 || c.BaseEjectionTime < 0 || c.MaxEjectionTime < 0 {
+		return fmt.Errorf("outlier detection settings can not be negative")
+	}
+	if c.MaxEjectionPercent < 0 || c.MaxEjectionPercent > 100 {
+		return fmt.Errorf("max ejection percent must be between 0 and 100")
+	}
+	if c.ConsecutiveFailures == 0 {
+		c.ConsecutiveFailures = 5
+	}
+	if c.BaseEjectionTime == 0 {
+		c.BaseEjectionTime = Duration(30 * time.Second)
+	}
+	if c.MaxEjectionTime == 0 {
+		c.MaxEjectionTime = Duration(5 * time.Minute)
+	}
+	if c.MaxEjectionTime < c.BaseEjectionTime {
+		c.MaxEjectionTime = c.BaseEjectionTime
+	}
+	if c.MaxEjectionPercent == 0 {
+		c.MaxEjectionPercent = 50
+	}
+	return nil
+}
+
+func (c OutlierConfig) maxEjected(poolSize int) int {
+	max := poolSize * c.MaxEjectionPercent / 100
+	if max < 1 {
+		max = 1
+	}
+	return max
+}
+
+// ejectionTime returns how long the n-th ejection in a row lasts.
+func (c OutlierConfig) ejectionTime(n int) time.Duration {
+	d := time.Duration(c.BaseEjectionTime)
+	for i := 1; i < n && d < time.Duration(c.MaxEjectionTime); i++ {
+		d *= 2
+	}
+	if d > time.Duration(c.MaxEjectionTime) {
+		d = time.Duration(c.MaxEjectionTime)
+	}
+	return d
+}
+
+func isFailure(status int, err error) bool {
+	return err != nil || status >= http.StatusInternalServerError
+}
+
+// passiveResult records the outcome of a request forwarded to the backend
+// and reports whether the backend has just reached the failure threshold.
+func (b *Backend) passiveResult(now time.Time, failed bool, config OutlierConfig) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !failed {
+		b.passiveFailures = 0
+		// The backend behaved for a whole base period since it came back, so
+		// its next ejection starts from the base time again.
+		if b.ejections > 0 && now.After(b.ejectedUntil.Add(time.Duration(config.BaseEjectionTime))) {
+			b.ejections = 0
+		}
+		return false
+	}
+	if now.Before(b.ejectedUntil) {
+		return false
+	}
+	b.passiveFailures++
+	return b.passiveFailures >= config.ConsecutiveFailures
+}
+
+func (b *Backend) eject(now time.Time, config OutlierConfig) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.ejections++
+	b.metrics.ejection()
+	b.passiveFailures = 0
+	d := config.ejectionTime(b.ejections)
+	b.ejectedUntil = now.Add(d)
+	log.Printf("Backend %s ejected for %s", b.config.Address, d)
+}
+
+func (b *Backend) isEjected(now time.Time) bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return now.Before(b.ejectedUntil)
+}
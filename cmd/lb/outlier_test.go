@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type OutlierSuite struct{}
+
+var _ = check.Suite(&OutlierSuite{})
+
+func outlierPool(c *check.C, config OutlierConfig, addresses ...string) *Pool {
+	c.Assert(config.normalize(), check.IsNil)
+	pool := testPool(c, &roundRobin{}, addresses...)
+	pool.SetOutlierDetection(config)
+	return pool
+}
+
+func (s *OutlierSuite) TestEjectionTime(c *check.C) {
+	config := OutlierConfig{BaseEjectionTime: Duration(time.Second), MaxEjectionTime: Duration(5 * time.Second)}
+	c.Assert(config.normalize(), check.IsNil)
+	for n, d := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		c.Check(config.ejectionTime(n+1), check.Equals, d)
+	}
+}
+
+func (s *OutlierSuite) TestEjectAndReadmit(c *check.C) {
+	pool := outlierPool(c, OutlierConfig{
+		ConsecutiveFailures: 3,
+		BaseEjectionTime:    Duration(50 * time.Millisecond),
+	}, "a:8080", "b:8080", "c:8080")
+	defer pool.Stop()
+
+	server := pool.Servers()[0]
+	pool.Report(&server, http.StatusInternalServerError, nil, 0)
+	pool.Report(&server, http.StatusOK, nil, 0)
+	pool.Report(&server, 0, fmt.Errorf("connection refused"), 0)
+	pool.Report(&server, http.StatusBadGateway, nil, 0)
+	c.Check(pool.Servers()[0].IsAlive, check.Equals, true)
+
+	pool.Report(&server, http.StatusServiceUnavailable, nil, 0)
+	snapshot := pool.Servers()[0]
+	c.Check(snapshot.IsAlive, check.Equals, false)
+	c.Check(snapshot.Ejected, check.Equals, true)
+	c.Check(len(aliveIndexes(pool.Servers())), check.Equals, 2)
+
+	waitFor(c, func() bool { return pool.Servers()[0].IsAlive })
+	c.Check(server.backend.ejections, check.Equals, 1)
+
+	// The second ejection in a row lasts twice as long.
+	for i := 0; i < 3; i++ {
+		pool.Report(&server, http.StatusInternalServerError, nil, 0)
+	}
+	server.backend.mutex.RLock()
+	c.Check(server.backend.ejections, check.Equals, 2)
+	remaining := time.Until(server.backend.ejectedUntil)
+	server.backend.mutex.RUnlock()
+	c.Check(remaining > 50*time.Millisecond, check.Equals, true)
+}
+
+func (s *OutlierSuite) TestMaxEjectionPercent(c *check.C) {
+	pool := outlierPool(c, OutlierConfig{
+		ConsecutiveFailures: 1,
+		MaxEjectionPercent:  50,
+	}, "a:8080", "b:8080", "c:8080", "d:8080")
+	defer pool.Stop()
+
+	servers := pool.Servers()
+	for i := range servers {
+		pool.Report(&servers[i], http.StatusInternalServerError, nil, 0)
+	}
+	c.Check(len(aliveIndexes(pool.Servers())), check.Equals, 2)
+}
+
+func (s *OutlierSuite) TestDisabled(c *check.C) {
+	pool := outlierPool(c, OutlierConfig{Disabled: true, ConsecutiveFailures: 1}, "a:8080")
+	defer pool.Stop()
+
+	server := pool.Servers()[0]
+	pool.Report(&server, http.StatusInternalServerError, nil, 0)
+	c.Check(pool.Servers()[0].IsAlive, check.Equals, true)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var errUnknownBackend = fmt.Errorf("balancer: unknown backend")
+
+// Pool is the set of backends the balancer forwards to. The set can be
+// replaced at runtime with Update; every backend in it has its own health
+// checking goroutine that lives as long as the backend stays in the pool.
+type Pool struct {
+	mutex     sync.RWMutex
+	backends  []*Backend
+	strategy  Strategy
+	outlier   OutlierConfig
+	breaker   BreakerConfig
+	retry     RetryConfig
+	budget    *retryBudget
+	upgrade   UpgradeConfig
+	streaming StreamingConfig
+	sticky    stickiness
+	slowStart SlowStartConfig
+	prober    Prober
+
+	transport   TransportConfig
+	upstreamTLS UpstreamTLSConfig
+	tlsConfig   *tls.Config
+
+	// ejectMutex makes counting and ejecting backends atomic.
+	ejectMutex sync.Mutex
+}
+
+func NewPool(strategy Strategy) *Pool {
+	var retry RetryConfig
+	_ = retry.normalize()
+	var upgrade UpgradeConfig
+	_ = upgrade.normalize()
+	var streaming StreamingConfig
+	_ = streaming.normalize()
+	var transport TransportConfig
+	_ = transport.normalize()
+	var sticky StickyConfig
+	_ = sticky.normalize()
+	return &Pool{
+		strategy:  strategy,
+		retry:     retry,
+		budget:    newRetryBudget(retry),
+		upgrade:   upgrade,
+		streaming: streaming,
+		prober:    probe,
+		transport: transport,
+		sticky:    newStickiness(sticky, randomKey()),
+	}
+}
+
+func (p *Pool) SetStrategy(strategy Strategy) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.strategy = strategy
+}
+
+func (p *Pool) SetOutlierDetection(config OutlierConfig) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.outlier = config
+}
+
+func (p *Pool) SetCircuitBreaker(config BreakerConfig) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.breaker = config
+	for _, b := range p.backends {
+		b.breaker.configure(config)
+	}
+}
+
+// SetRetry changes the retry settings of the pool, the retry budget starts
+// over if they differ from the current ones.
+func (p *Pool) SetRetry(config RetryConfig) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !reflect.DeepEqual(config, p.retry) {
+		p.retry = config
+		p.budget = newRetryBudget(config)
+	}
+}
+
+func (p *Pool) Retry() (RetryConfig, *retryBudget) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.retry, p.budget
+}
+
+func (p *Pool) SetUpgrade(config UpgradeConfig) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.upgrade = config
+}
+
+func (p *Pool) Upgrade() UpgradeConfig {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.upgrade
+}
+
+func (p *Pool) SetStreaming(config StreamingConfig) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.streaming = config
+}
+
+func (p *Pool) Streaming() StreamingConfig {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.streaming
+}
+
+func (p *Pool) SetSlowStart(config SlowStartConfig) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.slowStart = config
+	for _, b := range p.backends {
+		b.setSlowStart(config)
+	}
+}
+
+// SetSticky changes the sticky session settings of the pool. Without a
+// secret the cookies keep being signed with the random key of the pool.
+func (p *Pool) SetSticky(config StickyConfig) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.sticky = newStickiness(config, p.sticky.fallbackKey)
+}
+
+func (p *Pool) Sticky() stickiness {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.sticky
+}
+
+// SetTransport changes the settings of the connections to the backends. If
+// they differ from the current ones, the backends get new transports and the
+// idle connections made with the old settings are closed.
+func (p *Pool) SetTransport(config TransportConfig) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if reflect.DeepEqual(config, p.transport) {
+		return
+	}
+	p.transport = config
+	for _, b := range p.backends {
+		b.setTransport(p.transport, p.tlsConfig)
+	}
+}
+
+// buildUpstreamTLS returns the TLS settings of config for the connections to
+// the backends. The files of config are read only when it differs from the
+// config the current settings were built from.
+func (p *Pool) buildUpstreamTLS(config UpstreamTLSConfig) (*tls.Config, error) {
+	p.mutex.RLock()
+	current := p.tlsConfig
+	unchanged := reflect.DeepEqual(config, p.upstreamTLS)
+	p.mutex.RUnlock()
+	if current != nil && unchanged {
+		return current, nil
+	}
+	return config.build()
+}
+
+// setUpstreamTLS makes tlsConfig, built from config by buildUpstreamTLS,
+// the TLS settings of the pool. If they changed, the backends get new
+// transports like with SetTransport.
+func (p *Pool) setUpstreamTLS(config UpstreamTLSConfig, tlsConfig *tls.Config) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if tlsConfig == p.tlsConfig {
+		return
+	}
+	p.upstreamTLS = config
+	p.tlsConfig = tlsConfig
+	for _, b := range p.backends {
+		b.setTransport(p.transport, p.tlsConfig)
+	}
+}
+
+// Pick chooses a backend for r with the current strategy of the pool. The
+// backends listed in exclude are treated as dead.
+func (p *Pool) Pick(r *http.Request, exclude ...string) (*Server, error) {
+	p.mutex.RLock()
+	strategy := p.strategy
+	p.mutex.RUnlock()
+	servers := p.Servers()
+	for i := range servers {
+		for _, name := range exclude {
+			if servers[i].Name == name {
+				servers[i].IsAlive = false
+			}
+		}
+	}
+	return strategy.Pick(r, servers)
+}
+
+// Servers returns snapshots of the current backends, so callers can keep
+// using them while the pool and the backends are being updated.
+func (p *Pool) Servers() []Server {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	servers := make([]Server, len(p.backends))
+	for i, b := range p.backends {
+		servers[i] = b.Snapshot()
+	}
+	return servers
+}
+
+// SetMode changes the mode of the backend with the given address.
+func (p *Pool) SetMode(address, mode string) error {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	for _, b := range p.backends {
+		if b.Config().Address == address {
+			return b.setMode(mode)
+		}
+	}
+	return errUnknownBackend
+}
+
+// Report feeds the outcome of a request forwarded to server back into
+// passive health checking and the circuit breaker of the backend.
+func (p *Pool) Report(server *Server, status int, err error, latency time.Duration) {
+	if server.backend == nil {
+		return
+	}
+	p.mutex.RLock()
+	config := p.outlier
+	backends := p.backends
+	p.mutex.RUnlock()
+
+	now := time.Now()
+	failed := isFailure(status, err)
+	server.backend.recordRequest(failed, latency)
+	server.backend.metrics.request(status, err, latency)
+	server.backend.breaker.record(now, failed, latency)
+	if config.Disabled || config.ConsecutiveFailures == 0 {
+		return
+	}
+	if !server.backend.passiveResult(now, failed, config) {
+		return
+	}
+
+	p.ejectMutex.Lock()
+	defer p.ejectMutex.Unlock()
+	ejected := 0
+	for _, b := range backends {
+		if b.isEjected(now) {
+			ejected++
+		}
+	}
+	if ejected >= config.maxEjected(len(backends)) {
+		log.Printf("Backend %s is failing, but %d of %d backends are already ejected",
+			server.Name, ejected, len(backends))
+		return
+	}
+	server.backend.eject(now, config)
+}
+
+// Update replaces the backends of the pool. Backends that are present in both
+// the old and the new set keep their state, new backends get a health
+// checker and removed backends have theirs stopped.
+func (p *Pool) Update(configs []BackendConfig) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	old := make(map[string]*Backend, len(p.backends))
+	for _, b := range p.backends {
+		old[b.Config().Address] = b
+	}
+
+	backends := make([]*Backend, 0, len(configs))
+	for _, config := range configs {
+		b, ok := old[config.Address]
+		if ok {
+			delete(old, config.Address)
+			if b.reconfigure(config) {
+				log.Printf("Backend %s changed", config.Address)
+			}
+		} else {
+			b = newBackend(config, p.prober)
+			b.setTransport(p.transport, p.tlsConfig)
+			b.setSlowStart(p.slowStart)
+			b.breaker.configure(p.breaker)
+			b.start()
+			log.Printf("Backend %s added", config.Address)
+		}
+		backends = append(backends, b)
+	}
+
+	for address, b := range old {
+		b.halt()
+		b.closeIdleConnections()
+		log.Printf("Backend %s removed", address)
+	}
+	p.backends = backends
+}
+
+// Stop terminates all health checkers of the pool.
+func (p *Pool) Stop() {
+	p.Update(nil)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type PoolSuite struct{}
+
+var _ = check.Suite(&PoolSuite{})
+
+func testBackendConfig(address string) BackendConfig {
+	config := &PoolConfig{Backends: []BackendConfig{{Address: address}}}
+	_ = config.normalize()
+	return config.Backends[0]
+}
+
+// fakeProber reports the backends listed in healthy as alive.
+func fakeProber(healthy ...string) Prober {
+	return func(dst Server, _ HealthCheckConfig) error {
+		for _, name := range healthy {
+			if dst.Name == name {
+				return nil
+			}
+		}
+		return fmt.Errorf("unexpected status 500")
+	}
+}
+
+func waitFor(c *check.C, condition func() bool) {
+	for deadline := time.Now().Add(time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			c.Fatal("condition is not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// testPool returns a pool of the given backends that are all alive.
+func testPool(c *check.C, strategy Strategy, addresses ...string) *Pool {
+	pool := NewPool(strategy)
+	pool.prober = fakeProber(addresses...)
+	configs := make([]BackendConfig, len(addresses))
+	for i, address := range addresses {
+		configs[i] = testBackendConfig(address)
+	}
+	pool.Update(configs)
+	waitFor(c, func() bool { return len(aliveIndexes(pool.Servers())) == len(addresses) })
+	return pool
+}
+
+func (s *PoolSuite) TestUpdate(c *check.C) {
+	pool := NewPool(pathHash{})
+	pool.prober = fakeProber("server2:8080")
+	defer pool.Stop()
+
+	pool.Update(defaultConfig().Backends)
+	c.Assert(pool.Servers(), check.HasLen, 3)
+	kept := pool.backends[1]
+	waitFor(c, func() bool { return kept.Snapshot().IsAlive })
+
+	pool.Update([]BackendConfig{
+		testBackendConfig("server2:8080"),
+		testBackendConfig("server4:8080"),
+	})
+	servers := pool.Servers()
+	c.Assert(servers, check.HasLen, 2)
+	c.Check(servers[0].Name, check.Equals, "server2:8080")
+	c.Check(servers[0].IsAlive, check.Equals, true)
+	c.Check(servers[0].backend, check.Equals, kept)
+	c.Check(servers[1].Name, check.Equals, "server4:8080")
+
+	changed := testBackendConfig("server2:8080")
+	changed.HealthCheck.Path = "/ping"
+	changed.HealthPath = "/ping"
+	pool.Update([]BackendConfig{changed})
+	servers = pool.Servers()
+	c.Assert(servers, check.HasLen, 1)
+	c.Check(servers[0].backend, check.Equals, kept)
+	c.Check(servers[0].HealthPath, check.Equals, "/ping")
+	waitFor(c, func() bool { return kept.Snapshot().IsAlive })
+}
+
+func (s *PoolSuite) TestHealthHistory(c *check.C) {
+	b := newBackend(testBackendConfig("server1:8080"), nil)
+	stop := make(chan struct{})
+	b.stop = stop
+	at := time.Now()
+
+	b.record(stop, at, time.Millisecond, nil)
+	b.record(stop, at, 2*time.Millisecond, nil)
+	server := b.Snapshot()
+	c.Check(server.IsAlive, check.Equals, true)
+	c.Check(server.Health, check.DeepEquals, HealthState{
+		LastCheck:            at,
+		ConsecutiveSuccesses: 2,
+		Latency:              2 * time.Millisecond,
+	})
+
+	b.record(stop, at, 3*time.Millisecond, fmt.Errorf("unexpected status 500"))
+	server = b.Snapshot()
+	c.Check(server.IsAlive, check.Equals, false)
+	c.Check(server.Health.LastError, check.Equals, "unexpected status 500")
+	c.Check(server.Health.ConsecutiveSuccesses, check.Equals, 0)
+	c.Check(server.Health.ConsecutiveFailures, check.Equals, 1)
+
+	// Results of a stopped checker are ignored.
+	b.halt()
+	c.Check(b.stop, check.IsNil)
+	b.record(stop, at, time.Millisecond, nil)
+	c.Check(b.Snapshot().IsAlive, check.Equals, false)
+}
+
+// TestConcurrentAccess is meant to be run with -race.
+func (s *PoolSuite) TestConcurrentAccess(c *check.C) {
+	pool := NewPool(&roundRobin{})
+	pool.prober = fakeProber("server1:8080", "server2:8080", "server3:8080")
+	defer pool.Stop()
+	pool.Update(defaultConfig().Backends)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			b := pool.backends[i%3]
+			b.mutex.RLock()
+			stop := b.stop
+			b.mutex.RUnlock()
+			b.record(stop, time.Now(), time.Millisecond, nil)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			if server, err := pool.Pick(httptest.NewRequest("GET", "/", nil)); err == nil {
+				server.track()()
+			}
+		}
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// proxy balances requests between the backends of the pool routes choose
+// for them, pool if there is no route, retrying failed ones on other
+// backends when the retry settings of the pool allow it.
+type proxy struct {
+	pool      *Pool
+	routes    *routeTable
+	accessLog *accessLog
+	forwarder *forwarder
+	limiter   *rateLimiter
+}
+
+func (p *proxy) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	removeClientHopHeaders(r)
+	r = p.forwarder.rewrite(r)
+	entry := accessEntry{
+		Time:      time.Now(),
+		Client:    clientIP(r),
+		Method:    r.Method,
+		URI:       r.RequestURI,
+		Proto:     r.Proto,
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+		RequestID: r.Header.Get(requestIDHeader),
+	}
+	if entry.RequestID == "" {
+		entry.RequestID = uuid.NewString()
+		r.Header.Set(requestIDHeader, entry.RequestID)
+	}
+	rw.Header().Set(requestIDHeader, entry.RequestID)
+
+	limit := p.limiter.allow(r)
+	if limit != nil {
+		limit.writeHeaders(rw.Header())
+	}
+
+	logger := &responseLogger{ResponseWriter: rw}
+	var err error
+	route := p.routes.match(r, p.pool)
+	if limit != nil && !limit.allowed {
+		streaming := route.pool.Streaming()
+		setWriteDeadline(r, streaming.writeTimeout(r.URL.Path))
+		logger.WriteHeader(http.StatusTooManyRequests)
+		logger.Write([]byte("too many requests"))
+	} else {
+		err = p.forward(route, logger, route.rewriteRequest(r), &entry)
+	}
+	entry.Status = logger.status
+	entry.Bytes = logger.bytes
+	entry.Latency = time.Since(entry.Time)
+	p.accessLog.write(&entry)
+	if err != nil {
+		// Abort the response, so the client can tell it is incomplete.
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// forward sends r to a backend of the pool of route and copies the response
+// to rw, filling in the upstream details of entry. It returns an error if
+// the response was cut short.
+func (p *proxy) forward(route *route, rw http.ResponseWriter, r *http.Request, entry *accessEntry) error {
+	pool := route.pool
+	streaming := pool.Streaming()
+	timeout := streaming.writeTimeout(r.URL.Path)
+	// The deadline of the client connection bounds the writes to a client
+	// that stops reading, the one of the context the wait for the backend.
+	setWriteDeadline(r, timeout)
+	if isUpgrade(r) && !pool.Upgrade().Disabled {
+		return p.upgrade(route, rw, r, entry)
+	}
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	retry, budget := pool.Retry()
+	budget.request()
+
+	retries := 0
+	if !retry.Disabled && retry.allowsMethod(r.Method) {
+		body, ok := bufferBody(r, retry.MaxBodyBytes)
+		if ok {
+			retries = retry.Retries
+			if body != nil {
+				r.GetBody = func() (io.ReadCloser, error) {
+					return ioutil.NopCloser(bytes.NewReader(body)), nil
+				}
+			}
+		}
+	}
+
+	server, err := p.pick(pool, r, nil)
+	if err != nil {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		rw.Write([]byte(err.Error()))
+		return nil
+	}
+	tried := []string{server.Name}
+	for try := 0; ; try++ {
+		if err := r.Context().Err(); err != nil {
+			server.release()
+			log.Printf("Client gave up before the request was sent to %s: %s", server.Name, err)
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return nil
+		}
+		done := server.track()
+		ctx := newTryContext(r.Context(), time.Duration(retry.PerTryTimeout))
+		start := time.Now()
+		resp, err := roundTrip(ctx, *server, r)
+		ctx.received()
+		err = ctx.wrap(err)
+		status := http.StatusServiceUnavailable
+		if err == nil {
+			status = resp.StatusCode
+		}
+		latency := time.Since(start)
+		if r.Context().Err() == nil {
+			pool.Report(server, status, err, latency)
+		} else {
+			server.cancelled()
+		}
+		entry.Backend = server.Name
+		entry.Retries = try
+		entry.UpstreamLatency = latency
+		entry.UpstreamStatus = 0
+		if err == nil {
+			entry.UpstreamStatus = status
+		}
+
+		if try < retries && r.Context().Err() == nil && retry.retryable(status, err) && budget.allowRetry() {
+			next, pickErr := p.pick(pool, r, tried)
+			if pickErr == nil {
+				if err != nil {
+					log.Printf("Failed to get response from %s, retrying on %s: %s", server.Name, next.Name, err)
+				} else {
+					log.Printf("Got %d from %s, retrying on %s", status, server.Name, next.Name)
+					resp.Body.Close()
+				}
+				server.retried()
+				ctx.Close()
+				done()
+				server = next
+				tried = append(tried, server.Name)
+				continue
+			}
+		}
+
+		var copyErr error
+		if err != nil {
+			log.Printf("Failed to get response from %s: %s", server.Name, err)
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			route.rewriteResponse(resp.Header, r)
+			pool.Sticky().stick(rw, r, *server)
+			copyErr = copyResponse(rw, resp, *server, streaming.flushInterval(resp))
+		}
+		ctx.Close()
+		done()
+		return copyErr
+	}
+}
+
+// pick chooses a backend of pool for r that is not in tried and whose circuit
+// breaker lets the request through, preferring the one the client is pinned
+// to by a sticky session.
+func (p *proxy) pick(pool *Pool, r *http.Request, tried []string) (*Server, error) {
+	exclude := append([]string(nil), tried...)
+	if sticky := pool.Sticky(); sticky.Enabled {
+		if server := sticky.pinned(r, pool.Servers(), exclude); server != nil {
+			if server.acquire() {
+				return server, nil
+			}
+			exclude = append(exclude, server.Name)
+		}
+	}
+	for {
+		server, err := pool.Pick(r, exclude...)
+		if err != nil {
+			return nil, err
+		}
+		if server.acquire() {
+			return server, nil
+		}
+		exclude = append(exclude, server.Name)
+	}
+}
+
+// roundTrip sends r to dst. The body of r is taken from r.GetBody when it is
+// set, so the same request can be sent several times.
+func roundTrip(ctx context.Context, dst Server, r *http.Request) (*http.Response, error) {
+	fwdRequest := r.Clone(ctx)
+	fwdRequest.RequestURI = ""
+	fwdRequest.URL.Host = dst.Name
+	fwdRequest.URL.Scheme = dst.Scheme
+	fwdRequest.Host = dst.Name
+	// The other hop-by-hop headers of the client are removed by ServeHTTP.
+	fwdRequest.Header.Del("Connection")
+	fwdRequest.Header.Del("Upgrade")
+	fwdRequest.Header.Del("Te")
+	// The trailers of the request are filled in once its body is read to the
+	// end, share them with the forwarded one.
+	fwdRequest.Trailer = r.Trailer
+	if acceptsTrailers(r.Header) {
+		fwdRequest.Header.Set("Te", "trailers")
+	}
+	if r.GetBody != nil {
+		body, err := r.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		fwdRequest.Body = body
+	}
+	// Redirects are passed on to the client, the proxy does not follow them.
+	return dst.roundTripper().RoundTrip(fwdRequest)
+}
+
+// copyResponse writes resp to rw, flushing the body at most flushInterval
+// after it arrives. It returns an error if the body could not be copied.
+func copyResponse(rw http.ResponseWriter, resp *http.Response, dst Server, flushInterval time.Duration) error {
+	defer resp.Body.Close()
+	removeHopHeaders(resp.Header)
+	for k, values := range resp.Header {
+		for _, value := range values {
+			rw.Header().Add(k, value)
+		}
+	}
+	if *traceEnabled {
+		rw.Header().Set("lb-from", dst.Name)
+		rw.Header().Set("lb-breaker", dst.Breaker)
+	}
+	announced := len(resp.Trailer)
+	announceTrailers(rw, resp)
+	rw.WriteHeader(resp.StatusCode)
+	writer := newFlushWriter(rw, flushInterval)
+	_, err := io.Copy(writer, resp.Body)
+	writer.stop()
+	if err != nil {
+		log.Printf("Failed to write response: %s", err)
+		return err
+	}
+	// The trailers are only known once the body is read to the end.
+	resp.Body.Close()
+	copyTrailers(rw, resp, announced)
+	return nil
+}
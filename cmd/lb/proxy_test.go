@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type ProxySuite struct{}
+
+var _ = check.Suite(&ProxySuite{})
+
+// testBackend starts a backend that answers with its name and the request
+// body, or with status if it is not zero.
+func testBackend(c *check.C, name string, status int) (*httptest.Server, string) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if status != 0 {
+			rw.WriteHeader(status)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(rw, "%s %s %s", name, r.Method, body)
+	}))
+	address, err := url.Parse(backend.URL)
+	c.Assert(err, check.IsNil)
+	return backend, address.Host
+}
+
+// deadAddress returns an address nothing listens on.
+func deadAddress(c *check.C) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	address := listener.Addr().String()
+	listener.Close()
+	return address
+}
+
+func serve(handler http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rw
+}
+
+func (s *ProxySuite) TestRetryOnStatus(c *check.C) {
+	failing, failingAddress := testBackend(c, "failing", http.StatusBadGateway)
+	defer failing.Close()
+	good, goodAddress := testBackend(c, "good", 0)
+	defer good.Close()
+
+	pool := testPool(c, &roundRobin{}, failingAddress, goodAddress)
+	defer pool.Stop()
+	handler := &proxy{pool: pool}
+
+	for i := 0; i < 4; i++ {
+		rw := serve(handler, "PUT", "/data", "value")
+		c.Check(rw.Code, check.Equals, http.StatusOK)
+		c.Check(rw.Body.String(), check.Equals, "good PUT value")
+	}
+
+	// POST is not idempotent, so the failure reaches the client.
+	statuses := make(map[int]int)
+	for i := 0; i < 4; i++ {
+		statuses[serve(handler, "POST", "/data", "value").Code]++
+	}
+	c.Check(statuses, check.DeepEquals, map[int]int{http.StatusOK: 2, http.StatusBadGateway: 2})
+}
+
+func (s *ProxySuite) TestRetryOnConnectFailure(c *check.C) {
+	good, goodAddress := testBackend(c, "good", 0)
+	defer good.Close()
+
+	pool := testPool(c, &roundRobin{}, deadAddress(c), goodAddress)
+	defer pool.Stop()
+	pool.SetOutlierDetection(OutlierConfig{Disabled: true})
+	handler := &proxy{pool: pool}
+
+	for i := 0; i < 4; i++ {
+		rw := serve(handler, "GET", "/", "")
+		c.Check(rw.Code, check.Equals, http.StatusOK)
+		c.Check(rw.Body.String(), check.Equals, "good GET ")
+	}
+
+	retry, _ := pool.Retry()
+	retry.Disabled = true
+	pool.SetRetry(retry)
+	statuses := make(map[int]int)
+	for i := 0; i < 4; i++ {
+		statuses[serve(handler, "GET", "/", "").Code]++
+	}
+	c.Check(statuses, check.DeepEquals, map[int]int{http.StatusOK: 2, http.StatusServiceUnavailable: 2})
+}
+
+func (s *ProxySuite) TestLastResponseIsKept(c *check.C) {
+	failing, failingAddress := testBackend(c, "failing", http.StatusServiceUnavailable)
+	defer failing.Close()
+
+	pool := testPool(c, &roundRobin{}, failingAddress)
+	defer pool.Stop()
+
+	rw := serve(&proxy{pool: pool}, "GET", "/", "")
+	c.Check(rw.Code, check.Equals, http.StatusServiceUnavailable)
+	c.Check(rw.Body.String(), check.Equals, "failing GET ")
+}
+
+func (s *ProxySuite) TestBufferBody(c *check.C) {
+	r := httptest.NewRequest("PUT", "/", strings.NewReader("0123456789"))
+	body, ok := bufferBody(r, 10)
+	c.Check(ok, check.Equals, true)
+	c.Check(string(body), check.Equals, "0123456789")
+
+	r = httptest.NewRequest("PUT", "/", ioutil.NopCloser(strings.NewReader("0123456789")))
+	r.ContentLength = -1
+	body, ok = bufferBody(r, 5)
+	c.Check(ok, check.Equals, false)
+	c.Check(body, check.IsNil)
+	rest, err := ioutil.ReadAll(r.Body)
+	c.Check(err, check.IsNil)
+	c.Check(string(rest), check.Equals, "0123456789")
+}
+
+func (s *ProxySuite) TestErrorClass(c *check.C) {
+	_, err := http.Get("http://" + deadAddress(c))
+	c.Check(errorClass(err), check.Equals, retryOnConnect)
+
+	slow := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer slow.Close()
+	_, err = (&http.Client{Timeout: 10 * time.Millisecond}).Get(slow.URL)
+	c.Check(errorClass(err), check.Equals, retryOnTimeout)
+
+	c.Check(errorClass(fmt.Errorf("EOF")), check.Equals, retryOnReset)
+}
+
+func (s *ProxySuite) TestRetryBudget(c *check.C) {
+	budget := newRetryBudget(RetryConfig{BudgetPercent: 20, MinRetries: 2})
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		budget.request()
+		if budget.allowRetry() {
+			allowed++
+		}
+	}
+	c.Check(allowed, check.Equals, 4)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyPrefix keys a rate limit rule by its path prefix alone, so all the
+// requests it applies to share a single bucket.
+const keyPrefix = "prefix"
+
+// RateLimitConfig limits the rate of requests with token buckets. A request
+// is checked against every rule whose PathPrefix its path starts with and is
+// answered with 429 Too Many Requests without reaching a backend if any of
+// them has no tokens left. At most MaxBuckets buckets are kept, the least
+// recently used ones are dropped first.
+type RateLimitConfig struct {
+	Disabled   bool            `json:"disabled"`
+	MaxBuckets int             `json:"maxBuckets"`
+	Rules      []RateLimitRule `json:"rules"`
+}
+
+// RateLimitRule allows Rate requests per second with bursts of up to Burst
+// requests for every value of Key: a key expression like the hash key of
+// the strategies, "ip" by default, or "prefix" for a single bucket shared by
+// all requests of the rule.
+type RateLimitRule struct {
+	PathPrefix string  `json:"pathPrefix"`
+	Key        string  `json:"key"`
+	Rate       float64 `json:"rate"`
+	Burst      int     `json:"burst"`
+
+	key KeyExpr
+}
+
+func (c *RateLimitConfig) normalize() error {
+	if c.MaxBuckets < 0 {
+		return fmt.Errorf("rate limit can not keep a negative number of buckets")
+	}
+	if c.MaxBuckets == 0 {
+		c.MaxBuckets = 10000
+	}
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if rule.PathPrefix == "" {
+			rule.PathPrefix = "/"
+		}
+		if !strings.HasPrefix(rule.PathPrefix, "/") {
+			return fmt.Errorf("rate limit rule %d has path prefix not starting with /", i)
+		}
+		if rule.Rate <= 0 {
+			return fmt.Errorf("rate limit rule %d needs a positive rate", i)
+		}
+		if rule.Burst < 0 {
+			return fmt.Errorf("rate limit rule %d has a negative burst", i)
+		}
+		if rule.Burst == 0 {
+			rule.Burst = int(math.Ceil(rule.Rate))
+		}
+		if rule.Key == "" {
+			rule.Key = "ip"
+		}
+		if rule.Key != keyPrefix {
+			key, err := ParseKeyExpr(rule.Key)
+			if err != nil {
+				return fmt.Errorf("rate limit rule %d: %s", i, err)
+			}
+			rule.key = key
+		}
+	}
+	return nil
+}
+
+func (r *RateLimitRule) bucketKey(index int, req *http.Request) string {
+	if r.Key == keyPrefix {
+		return strconv.Itoa(index)
+	}
+	return strconv.Itoa(index) + "\x00" + r.key.Key(req)
+}
+
+// tokenBucket holds up to burst tokens and gains rate of them per second.
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time, rule RateLimitRule) {
+	b.tokens = math.Min(float64(rule.Burst), b.tokens+now.Sub(b.last).Seconds()*rule.Rate)
+	b.last = now
+}
+
+// rateLimit is the outcome of checking a request against the rule that
+// limits it the most.
+type rateLimit struct {
+	allowed   bool
+	limit     int
+	remaining int
+	// reset is when the bucket is full again, retry when it has a token.
+	reset time.Duration
+	retry time.Duration
+}
+
+// writeHeaders describes the limit to the client.
+func (l *rateLimit) writeHeaders(header http.Header) {
+	header.Set("RateLimit-Limit", strconv.Itoa(l.limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(l.remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(seconds(l.reset)))
+	if !l.allowed {
+		header.Set("Retry-After", strconv.Itoa(seconds(l.retry)))
+	}
+}
+
+// seconds rounds d up to whole seconds.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// rateLimiter keeps the token buckets of the rate limit rules.
+type rateLimiter struct {
+	mutex   sync.Mutex
+	config  RateLimitConfig
+	buckets map[string]*list.Element
+	// recent lists the buckets from the most to the least recently used.
+	recent *list.List
+	now    func() time.Time
+}
+
+// configure applies config, the buckets start over if the rules change.
+func (l *rateLimiter) configure(config RateLimitConfig) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.buckets == nil || !reflect.DeepEqual(config.Rules, l.config.Rules) {
+		l.buckets = make(map[string]*list.Element)
+		l.recent = list.New()
+	}
+	l.config = config
+	l.evictLocked()
+}
+
+func (l *rateLimiter) evictLocked() {
+	for l.recent.Len() > l.config.MaxBuckets {
+		oldest := l.recent.Back()
+		l.recent.Remove(oldest)
+		delete(l.buckets, oldest.Value.(*tokenBucket).key)
+	}
+}
+
+// bucketLocked returns the bucket of key, a full one if there is none yet.
+// A bucket that is dropped is full again by the time it is idle long enough
+// to be the least recently used one, unless the limiter is too small.
+func (l *rateLimiter) bucketLocked(key string, rule RateLimitRule, now time.Time) *tokenBucket {
+	if element, ok := l.buckets[key]; ok {
+		l.recent.MoveToFront(element)
+		bucket := element.Value.(*tokenBucket)
+		bucket.refill(now, rule)
+		return bucket
+	}
+	bucket := &tokenBucket{key: key, tokens: float64(rule.Burst), last: now}
+	l.buckets[key] = l.recent.PushFront(bucket)
+	l.evictLocked()
+	return bucket
+}
+
+// allow takes a token for r from the bucket of every rule applying to it,
+// unless one of them is empty. It returns nil if no rule applies.
+func (l *rateLimiter) allow(r *http.Request) *rateLimit {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.config.Disabled || l.buckets == nil {
+		return nil
+	}
+	now := time.Now()
+	if l.now != nil {
+		now = l.now()
+	}
+
+	type match struct {
+		rule   RateLimitRule
+		bucket *tokenBucket
+	}
+	var matches []match
+	allowed := true
+	for i, rule := range l.config.Rules {
+		if !strings.HasPrefix(r.URL.Path, rule.PathPrefix) {
+			continue
+		}
+		bucket := l.bucketLocked(rule.bucketKey(i, r), rule, now)
+		matches = append(matches, match{rule, bucket})
+		if bucket.tokens < 1 {
+			allowed = false
+		}
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+
+	var result *rateLimit
+	for _, m := range matches {
+		if allowed {
+			m.bucket.tokens--
+		}
+		perToken := time.Duration(float64(time.Second) / m.rule.Rate)
+		limit := &rateLimit{
+			allowed:   allowed,
+			limit:     m.rule.Burst,
+			remaining: int(m.bucket.tokens),
+			reset:     time.Duration((float64(m.rule.Burst) - m.bucket.tokens) * float64(perToken)),
+			retry:     time.Duration((1 - m.bucket.tokens) * float64(perToken)),
+		}
+		if limit.retry < 0 {
+			limit.retry = 0
+		}
+		if result == nil || limit.remaining < result.remaining ||
+			(limit.remaining == result.remaining && limit.retry > result.retry) {
+			result = limit
+		}
+	}
+	return result
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type RateLimitSuite struct{}
+
+var _ = check.Suite(&RateLimitSuite{})
+
+// testLimiter returns a limiter of rules with a clock moved by the returned
+// function.
+func testLimiter(c *check.C, maxBuckets int, rules ...RateLimitRule) (*rateLimiter, func(time.Duration)) {
+	config := RateLimitConfig{MaxBuckets: maxBuckets, Rules: rules}
+	c.Assert(config.normalize(), check.IsNil)
+	now := time.Now()
+	limiter := &rateLimiter{now: func() time.Time { return now }}
+	limiter.configure(config)
+	return limiter, func(d time.Duration) { now = now.Add(d) }
+}
+
+func limitedRequest(path, ip string) *http.Request {
+	r := httptest.NewRequest("GET", path, nil)
+	r.RemoteAddr = ip + ":1234"
+	return r
+}
+
+func (s *RateLimitSuite) TestNormalize(c *check.C) {
+	config := RateLimitConfig{Rules: []RateLimitRule{{Rate: 2.5}}}
+	c.Assert(config.normalize(), check.IsNil)
+	c.Check(config.MaxBuckets, check.Equals, 10000)
+	c.Check(config.Rules[0].PathPrefix, check.Equals, "/")
+	c.Check(config.Rules[0].Key, check.Equals, "ip")
+	c.Check(config.Rules[0].Burst, check.Equals, 3)
+
+	for _, rule := range []RateLimitRule{
+		{},
+		{Rate: 1, PathPrefix: "api"},
+		{Rate: 1, Key: "header"},
+		{Rate: 1, Burst: -1},
+	} {
+		config := RateLimitConfig{Rules: []RateLimitRule{rule}}
+		c.Check(config.normalize(), check.NotNil, check.Commentf("%+v", rule))
+	}
+}
+
+func (s *RateLimitSuite) TestTokenBucket(c *check.C) {
+	limiter, advance := testLimiter(c, 0, RateLimitRule{Rate: 1, Burst: 2})
+
+	for remaining := 1; remaining >= 0; remaining-- {
+		limit := limiter.allow(limitedRequest("/", "10.0.0.1"))
+		c.Assert(limit, check.NotNil)
+		c.Check(limit.allowed, check.Equals, true)
+		c.Check(limit.remaining, check.Equals, remaining)
+	}
+	limit := limiter.allow(limitedRequest("/", "10.0.0.1"))
+	c.Check(limit.allowed, check.Equals, false)
+	c.Check(limit.retry, check.Equals, time.Second)
+	c.Check(limit.reset, check.Equals, 2*time.Second)
+
+	// Other clients have buckets of their own.
+	c.Check(limiter.allow(limitedRequest("/", "10.0.0.2")).allowed, check.Equals, true)
+
+	advance(500 * time.Millisecond)
+	limit = limiter.allow(limitedRequest("/", "10.0.0.1"))
+	c.Check(limit.allowed, check.Equals, false)
+	c.Check(limit.retry, check.Equals, 500*time.Millisecond)
+	advance(500 * time.Millisecond)
+	c.Check(limiter.allow(limitedRequest("/", "10.0.0.1")).allowed, check.Equals, true)
+}
+
+func (s *RateLimitSuite) TestKeys(c *check.C) {
+	limiter, _ := testLimiter(c, 0,
+		RateLimitRule{PathPrefix: "/api", Key: "header:X-Api-Key", Rate: 1},
+		RateLimitRule{PathPrefix: "/upload", Key: keyPrefix, Rate: 1},
+	)
+	c.Check(limiter.allow(limitedRequest("/static", "10.0.0.1")), check.IsNil)
+
+	withKey := func(key string) *http.Request {
+		r := limitedRequest("/api/users", "10.0.0.1")
+		r.Header.Set("X-Api-Key", key)
+		return r
+	}
+	c.Check(limiter.allow(withKey("a")).allowed, check.Equals, true)
+	c.Check(limiter.allow(withKey("a")).allowed, check.Equals, false)
+	c.Check(limiter.allow(withKey("b")).allowed, check.Equals, true)
+
+	c.Check(limiter.allow(limitedRequest("/upload/1", "10.0.0.1")).allowed, check.Equals, true)
+	c.Check(limiter.allow(limitedRequest("/upload/2", "10.0.0.2")).allowed, check.Equals, false)
+}
+
+func (s *RateLimitSuite) TestEviction(c *check.C) {
+	limiter, _ := testLimiter(c, 2, RateLimitRule{Rate: 1})
+	c.Check(limiter.allow(limitedRequest("/", "10.0.0.1")).allowed, check.Equals, true)
+	c.Check(limiter.allow(limitedRequest("/", "10.0.0.2")).allowed, check.Equals, true)
+	c.Check(limiter.allow(limitedRequest("/", "10.0.0.2")).allowed, check.Equals, false)
+	c.Check(limiter.allow(limitedRequest("/", "10.0.0.3")).allowed, check.Equals, true)
+	c.Check(limiter.buckets, check.HasLen, 2)
+
+	// The least recently used bucket is gone and starts over full.
+	c.Check(limiter.allow(limitedRequest("/", "10.0.0.1")).allowed, check.Equals, true)
+	c.Check(limiter.allow(limitedRequest("/", "10.0.0.3")).allowed, check.Equals, false)
+}
+
+func (s *RateLimitSuite) TestProxy(c *check.C) {
+	backend, address := testBackend(c, "backend", 0)
+	defer backend.Close()
+	pool := testPool(c, &roundRobin{}, address)
+	defer pool.Stop()
+	limiter, _ := testLimiter(c, 0, RateLimitRule{Rate: 0.5})
+	handler := &proxy{pool: pool, limiter: limiter}
+
+	rw := serve(handler, "GET", "/", "")
+	c.Check(rw.Code, check.Equals, http.StatusOK)
+	c.Check(rw.Header().Get("RateLimit-Limit"), check.Equals, "1")
+	c.Check(rw.Header().Get("RateLimit-Remaining"), check.Equals, "0")
+	c.Check(rw.Header().Get("RateLimit-Reset"), check.Equals, "2")
+
+	rw = serve(handler, "GET", "/", "")
+	c.Check(rw.Code, check.Equals, http.StatusTooManyRequests)
+	c.Check(rw.Header().Get("Retry-After"), check.Equals, "2")
+	c.Check(pool.Servers()[0].Stats.Requests, check.Equals, uint64(1))
+}
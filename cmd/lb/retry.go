@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	retryOnConnect = "connect"
+	retryOnTimeout = "timeout"
+	retryOnReset   = "reset"
+
+	retryBudgetWindow = 10 * time.Second
+)
+
+// RetryConfig controls resending failed requests to other backends, up to
+// Retries times per request. PerTryTimeout bounds the wait for the response
+// headers of every try. Only requests with one of Methods and a body of
+// at most MaxBodyBytes are retried, after a response with one of RetryStatus
+// or an error of one of the RetryOn classes: "connect", "timeout" or
+// "reset". Retries are limited by a budget of BudgetPercent of the recent
+// requests, with MinRetries always allowed per budget window.
+type RetryConfig struct {
+	Disabled      bool     `json:"disabled"`
+	Retries       int      `json:"retries"`
+	PerTryTimeout Duration `json:"perTryTimeout"`
+	RetryOn       []string `json:"retryOn"`
+	RetryStatus   []int    `json:"retryStatus"`
+	Methods       []string `json:"methods"`
+	MaxBodyBytes  int64    `json:"maxBodyBytes"`
+	BudgetPercent int      `json:"budgetPercent"`
+	MinRetries    int      `json:"minRetries"`
+}
+
+func (c *RetryConfig) normalize() error {
+	if c.Retries < 0 || c.PerTryTimeout < 0 || c.MaxBodyBytes < 0 || c.BudgetPercent < 0 || c.MinRetries < 0 {
+		return fmt.Errorf("retry settings can not be negative")
+	}
+	if c.Retries == 0 {
+		c.Retries = 2
+	}
+	if c.PerTryTimeout == 0 {
+		c.PerTryTimeout = Duration(timeout)
+	}
+	if c.RetryOn == nil {
+		c.RetryOn = []string{retryOnConnect, retryOnReset}
+	}
+	for _, class := range c.RetryOn {
+		if class != retryOnConnect && class != retryOnTimeout && class != retryOnReset {
+			return fmt.Errorf("unknown retry error class %s", class)
+		}
+	}
+	if c.RetryStatus == nil {
+		c.RetryStatus = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	if c.Methods == nil {
+		c.Methods = []string{"GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE"}
+	}
+	for i := range c.Methods {
+		c.Methods[i] = strings.ToUpper(c.Methods[i])
+	}
+	if c.MaxBodyBytes == 0 {
+		c.MaxBodyBytes = 64 << 10
+	}
+	if c.BudgetPercent == 0 {
+		c.BudgetPercent = 20
+	}
+	if c.MinRetries == 0 {
+		c.MinRetries = 10
+	}
+	return nil
+}
+
+func (c *RetryConfig) allowsMethod(method string) bool {
+	for _, m := range c.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// retryable reports whether the outcome of a try is worth retrying.
+func (c *RetryConfig) retryable(status int, err error) bool {
+	if err != nil {
+		class := errorClass(err)
+		for _, retryOn := range c.RetryOn {
+			if retryOn == class {
+				return true
+			}
+		}
+		return false
+	}
+	for _, s := range c.RetryStatus {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// errorClass tells whether err happened while connecting to a backend, by
+// running out of time or after the connection was established.
+func errorClass(err error) string {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return retryOnConnect
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return retryOnConnect
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return retryOnTimeout
+	}
+	return retryOnReset
+}
+
+// bufferBody reads the body of r into memory so it can be sent more than
+// once. If the body is larger than limit it is not buffered and r.Body still
+// yields all of it.
+func bufferBody(r *http.Request, limit int64) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > limit {
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil || int64(len(body)) > limit {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false
+	}
+	r.Body.Close()
+	return body, true
+}
+
+// retryBudget counts requests and retries over the current and the
+// previous window to keep the share of retries under a limit.
+type retryBudget struct {
+	percent    int
+	minRetries int
+
+	mutex    sync.Mutex
+	window   time.Time
+	requests [2]int
+	retries  [2]int
+}
+
+func newRetryBudget(config RetryConfig) *retryBudget {
+	return &retryBudget{percent: config.BudgetPercent, minRetries: config.MinRetries}
+}
+
+func (b *retryBudget) rotate(now time.Time) {
+	switch elapsed := now.Sub(b.window); {
+	case elapsed >= 2*retryBudgetWindow:
+		b.requests, b.retries = [2]int{}, [2]int{}
+		b.window = now
+	case elapsed >= retryBudgetWindow:
+		b.requests = [2]int{0, b.requests[0]}
+		b.retries = [2]int{0, b.retries[0]}
+		b.window = b.window.Add(retryBudgetWindow)
+	}
+}
+
+func (b *retryBudget) request() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.rotate(time.Now())
+	b.requests[0]++
+}
+
+// allowRetry takes a retry from the budget if there is one left.
+func (b *retryBudget) allowRetry() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.rotate(time.Now())
+	retries := b.retries[0] + b.retries[1]
+	requests := b.requests[0] + b.requests[1]
+	if retries >= b.minRetries && retries*100 >= requests*b.percent {
+		return false
+	}
+	b.retries[0]++
+	return true
+}
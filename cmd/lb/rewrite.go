@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// rewriteVariables are the variables header values of rewrite rules can
+// refer to as $name or ${name}. request_count counts the requests of the
+// route since the config was loaded.
+var rewriteVariables = map[string]bool{
+	"request_id":    true,
+	"client_ip":     true,
+	"host":          true,
+	"method":        true,
+	"path":          true,
+	"request_count": true,
+}
+
+// RewriteConfig changes the requests of a route before they are forwarded
+// and the responses before they are sent back. The path first loses
+// StripPrefix, which is matched by whole segments, then PathRegex is
+// replaced with PathReplacement, which may refer to its groups as $1, and
+// finally AddPrefix is prepended.
+type RewriteConfig struct {
+	StripPrefix     string      `json:"stripPrefix"`
+	PathRegex       string      `json:"pathRegex"`
+	PathReplacement string      `json:"pathReplacement"`
+	AddPrefix       string      `json:"addPrefix"`
+	RequestHeaders  HeaderRules `json:"requestHeaders"`
+	ResponseHeaders HeaderRules `json:"responseHeaders"`
+
+	pathRegex *regexp.Regexp
+}
+
+// HeaderRules remove the headers in Remove, then set the ones in Set and
+// add the values in Add to the ones already there. The values may refer to
+// the rewrite variables, like "${request_count}".
+type HeaderRules struct {
+	Remove []string          `json:"remove"`
+	Set    map[string]string `json:"set"`
+	Add    map[string]string `json:"add"`
+}
+
+func (c *RewriteConfig) normalize() error {
+	for _, prefix := range []string{c.StripPrefix, c.AddPrefix} {
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("rewrite prefix %s does not start with /", prefix)
+		}
+	}
+	c.pathRegex = nil
+	if c.PathRegex != "" {
+		regex, err := regexp.Compile(c.PathRegex)
+		if err != nil {
+			return fmt.Errorf("invalid rewrite path regex: %s", err)
+		}
+		c.pathRegex = regex
+	} else if c.PathReplacement != "" {
+		return fmt.Errorf("rewrite path replacement needs a path regex")
+	}
+	if err := c.RequestHeaders.validate(); err != nil {
+		return fmt.Errorf("request headers: %s", err)
+	}
+	if err := c.ResponseHeaders.validate(); err != nil {
+		return fmt.Errorf("response headers: %s", err)
+	}
+	return nil
+}
+
+// path returns the rewritten path.
+func (c *RewriteConfig) path(path string) string {
+	// "/api" strips "/api" and "/api/x" but leaves "/apiary" alone.
+	if prefix := strings.TrimSuffix(c.StripPrefix, "/"); prefix != "" &&
+		(path == prefix || strings.HasPrefix(path, prefix+"/")) {
+		path = path[len(prefix):]
+		if path == "" {
+			path = "/"
+		}
+	}
+	if c.pathRegex != nil {
+		path = c.pathRegex.ReplaceAllString(path, c.PathReplacement)
+	}
+	if c.AddPrefix != "" {
+		path = strings.TrimSuffix(c.AddPrefix, "/") + path
+	}
+	return path
+}
+
+func (h *HeaderRules) validate() error {
+	for _, values := range []map[string]string{h.Set, h.Add} {
+		for name, value := range values {
+			var unknown []string
+			os.Expand(value, func(variable string) string {
+				if !rewriteVariables[variable] {
+					unknown = append(unknown, variable)
+				}
+				return ""
+			})
+			if len(unknown) > 0 {
+				return fmt.Errorf("header %s refers to unknown variable %s", name, unknown[0])
+			}
+		}
+	}
+	return nil
+}
+
+func (h *HeaderRules) apply(header http.Header, variables map[string]string) {
+	expand := func(value string) string {
+		return os.Expand(value, func(variable string) string { return variables[variable] })
+	}
+	for _, name := range h.Remove {
+		header.Del(name)
+	}
+	for name, value := range h.Set {
+		header.Set(name, expand(value))
+	}
+	for name, value := range h.Add {
+		header.Add(name, expand(value))
+	}
+}
+
+type rewriteKey struct{}
+
+// rewriteRequest applies the request rules of the route to r. The values of
+// the rewrite variables are attached to the returned request, so the
+// response rules see the same ones.
+func (rt *route) rewriteRequest(r *http.Request) *http.Request {
+	rules := &rt.config.Rewrite
+	variables := map[string]string{
+		"request_id":    r.Header.Get(requestIDHeader),
+		"client_ip":     clientIP(r),
+		"host":          r.Host,
+		"method":        r.Method,
+		"path":          r.URL.Path,
+		"request_count": strconv.FormatUint(rt.count(), 10),
+	}
+	r = r.WithContext(context.WithValue(r.Context(), rewriteKey{}, variables))
+	if path := rules.path(r.URL.Path); path != r.URL.Path {
+		u := *r.URL
+		u.Path = path
+		u.RawPath = ""
+		r.URL = &u
+	}
+	rules.RequestHeaders.apply(r.Header, variables)
+	return r
+}
+
+// rewriteResponse applies the response rules of the route to the headers of
+// the response to r.
+func (rt *route) rewriteResponse(header http.Header, r *http.Request) {
+	variables, _ := r.Context().Value(rewriteKey{}).(map[string]string)
+	rt.config.Rewrite.ResponseHeaders.apply(header, variables)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	"gopkg.in/check.v1"
+)
+
+type RewriteSuite struct{}
+
+var _ = check.Suite(&RewriteSuite{})
+
+func (s *RewriteSuite) TestPath(c *check.C) {
+	for _, t := range []struct {
+		config RewriteConfig
+		path   string
+		result string
+	}{
+		{RewriteConfig{}, "/a/b", "/a/b"},
+		{RewriteConfig{StripPrefix: "/app"}, "/app/a", "/a"},
+		{RewriteConfig{StripPrefix: "/app"}, "/app", "/"},
+		{RewriteConfig{StripPrefix: "/app/"}, "/app/a", "/a"},
+		{RewriteConfig{StripPrefix: "/app"}, "/other", "/other"},
+		{RewriteConfig{StripPrefix: "/api"}, "/apiary/x", "/apiary/x"},
+		{RewriteConfig{StripPrefix: "/api/"}, "/api", "/"},
+		{RewriteConfig{AddPrefix: "/api/v1/"}, "/some-data", "/api/v1/some-data"},
+		{RewriteConfig{PathRegex: `^/users/(\d+)$`, PathReplacement: "/user/$1"}, "/users/42", "/user/42"},
+		{RewriteConfig{StripPrefix: "/v2", PathRegex: `^/data`, PathReplacement: "/some-data", AddPrefix: "/api/v1"}, "/v2/data", "/api/v1/some-data"},
+	} {
+		c.Assert(t.config.normalize(), check.IsNil)
+		c.Check(t.config.path(t.path), check.Equals, t.result, check.Commentf("%+v", t.config))
+	}
+}
+
+func (s *RewriteSuite) TestNormalize(c *check.C) {
+	for _, config := range []RewriteConfig{
+		{StripPrefix: "app"},
+		{PathReplacement: "/"},
+		{PathRegex: "("},
+		{RequestHeaders: HeaderRules{Set: map[string]string{"lb-author": "${user}"}}},
+		{ResponseHeaders: HeaderRules{Add: map[string]string{"X-Count": "$count"}}},
+	} {
+		c.Check(config.normalize(), check.NotNil, check.Commentf("%+v", config))
+	}
+}
+
+func (s *RewriteSuite) TestProxy(c *check.C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("X-Internal", "secret")
+		fmt.Fprintf(rw, "%s %s %s %q", r.URL.Path, r.Header.Get("lb-author"), r.Header.Get("lb-req-cnt"), r.Header.Get("Cookie"))
+	}))
+	defer backend.Close()
+	pool := testPool(c, &roundRobin{}, backend.Listener.Addr().String())
+	defer pool.Stop()
+
+	route := RouteConfig{PathPrefix: "/app/", Rewrite: RewriteConfig{
+		StripPrefix: "/app",
+		RequestHeaders: HeaderRules{
+			Remove: []string{"Cookie"},
+			Set:    map[string]string{"lb-author": "lb", "lb-req-cnt": "${request_count}"},
+		},
+		ResponseHeaders: HeaderRules{
+			Remove: []string{"X-Internal"},
+			Set:    map[string]string{"X-Path": "$path"},
+		},
+	}}
+	c.Assert(route.normalize(), check.IsNil)
+	routes := &routeTable{}
+	routes.configure([]RouteConfig{route}, map[string]*Pool{defaultPool: pool})
+	handler := &proxy{pool: pool, routes: routes}
+
+	for i := 1; i <= 2; i++ {
+		r := httptest.NewRequest("GET", "/app/some-data", nil)
+		r.Header.Set("Cookie", "session=1")
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, r)
+		c.Check(rw.Body.String(), check.Equals, fmt.Sprintf(`/some-data lb %d ""`, i))
+		c.Check(rw.Header().Get("X-Internal"), check.Equals, "")
+		c.Check(rw.Header().Get("X-Path"), check.Equals, "/app/some-data")
+	}
+
+	// Requests of no route are left alone.
+	rw := serve(handler, "GET", "/some-data", "")
+	c.Check(rw.Body.String(), check.Equals, `/some-data   ""`)
+	c.Check(rw.Header().Get("X-Internal"), check.Equals, "secret")
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const defaultVirtualNodes = 100
+
+type ringPoint struct {
+	hash  uint64
+	index int
+}
+
+// hashRing places every backend on a circle of 64-bit hashes as
+// virtualNodes*Weight points. A key belongs to the first point clockwise from
+// its hash, so adding or removing a backend only moves the keys of its own
+// points, and the keys of a dead backend are spread between the owners of
+// the points that follow its points.
+type hashRing struct {
+	signature string
+	points    []ringPoint
+}
+
+// mix64 is the splitmix64 finalizer. FNV alone clusters on the similar
+// strings used for virtual node names.
+func mix64(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+func ringSignature(servers []Server) string {
+	var b strings.Builder
+	for _, s := range servers {
+		fmt.Fprintf(&b, "%s*%d;", s.Name, s.Weight)
+	}
+	return b.String()
+}
+
+func newHashRing(servers []Server, virtualNodes int) *hashRing {
+	ring := &hashRing{signature: ringSignature(servers)}
+	for i, s := range servers {
+		weight := s.Weight
+		if weight < 1 {
+			weight = 1
+		}
+		for v := 0; v < virtualNodes*weight; v++ {
+			ring.points = append(ring.points, ringPoint{
+				hash:  mix64(hash64(fmt.Sprintf("%s#%d", s.Name, v))),
+				index: i,
+			})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		return ring.points[i].hash < ring.points[j].hash
+	})
+	return ring
+}
+
+// lookup returns the index of the server owning key, skipping dead ones and
+// the ones in their slow start window not taking the key yet.
+func (ring *hashRing) lookup(key string, servers []Server) (int, error) {
+	h := mix64(hash64(key))
+	start := sort.Search(len(ring.points), func(i int) bool {
+		return ring.points[i].hash >= h
+	})
+	fallback := -1
+	for n := 0; n < len(ring.points); n++ {
+		p := ring.points[(start+n)%len(ring.points)]
+		if s := &servers[p.index]; s.IsAlive {
+			if rampAccepts(h, s.Ramp) {
+				return p.index, nil
+			}
+			if fallback < 0 {
+				fallback = p.index
+			}
+		}
+	}
+	if fallback < 0 {
+		return 0, errNoAlive
+	}
+	return fallback, nil
+}
+
+// consistentHash sends all requests with the same key, the path by default,
+// to the same backend using a hashRing that is rebuilt only when the set of
+// backends changes.
+type consistentHash struct {
+	virtualNodes int
+	key          KeyExpr
+
+	mutex sync.Mutex
+	ring  *hashRing
+}
+
+func newConsistentHash(options StrategyOptions) (Strategy, error) {
+	key, err := ParseKeyExpr(options.HashKey)
+	if err != nil {
+		return nil, err
+	}
+	virtualNodes := options.VirtualNodes
+	if virtualNodes <= 0 {
+		virtualNodes = defaultVirtualNodes
+	}
+	return &consistentHash{virtualNodes: virtualNodes, key: key}, nil
+}
+
+func (s *consistentHash) currentRing(servers []Server) *hashRing {
+	signature := ringSignature(servers)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ring == nil || s.ring.signature != signature {
+		s.ring = newHashRing(servers, s.virtualNodes)
+	}
+	return s.ring
+}
+
+func (s *consistentHash) Pick(r *http.Request, servers []Server) (*Server, error) {
+	if len(servers) == 0 {
+		return nil, errNoAlive
+	}
+	index, err := s.currentRing(servers).lookup(s.key.Key(r), servers)
+	if err != nil {
+		return nil, err
+	}
+	return &servers[index], nil
+}
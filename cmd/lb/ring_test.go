@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+
+	"gopkg.in/check.v1"
+)
+
+type RingSuite struct{}
+
+var _ = check.Suite(&RingSuite{})
+
+func newRing(c *check.C, options StrategyOptions) *consistentHash {
+	strategy, err := newConsistentHash(options)
+	c.Assert(err, check.IsNil)
+	return strategy.(*consistentHash)
+}
+
+func ringOwners(c *check.C, strategy Strategy, servers []Server, keys int) map[string]string {
+	owners := make(map[string]string, keys)
+	for i := 0; i < keys; i++ {
+		path := fmt.Sprintf("/api/v1/some-data/%d", i)
+		server, err := strategy.Pick(httptest.NewRequest("GET", path, nil), servers)
+		c.Assert(err, check.IsNil)
+		owners[path] = server.Name
+	}
+	return owners
+}
+
+func (s *RingSuite) TestDistribution(c *check.C) {
+	owners := ringOwners(c, newRing(c, StrategyOptions{}), testServers(true, true, true), 3000)
+	counts := make(map[string]int)
+	for _, owner := range owners {
+		counts[owner]++
+	}
+	c.Check(counts, check.HasLen, 3)
+	for name, n := range counts {
+		c.Check(n > 800 && n < 1200, check.Equals, true, check.Commentf("%s got %d", name, n))
+	}
+}
+
+func (s *RingSuite) TestDeadBackendRemapsOnlyItsKeys(c *check.C) {
+	strategy := newRing(c, StrategyOptions{})
+	servers := testServers(true, true, true, true)
+	before := ringOwners(c, strategy, servers, 4000)
+
+	servers[1].IsAlive = false
+	after := ringOwners(c, strategy, servers, 4000)
+
+	spread := make(map[string]int)
+	for path, owner := range before {
+		if owner == servers[1].Name {
+			spread[after[path]]++
+		} else {
+			c.Check(after[path], check.Equals, owner)
+		}
+	}
+	c.Check(spread, check.HasLen, 3)
+	for name, n := range spread {
+		c.Check(n > 150, check.Equals, true, check.Commentf("%s got %d", name, n))
+	}
+}
+
+func (s *RingSuite) TestAddedBackendTakesFairShare(c *check.C) {
+	strategy := newRing(c, StrategyOptions{})
+	servers := testServers(true, true, true, true, true)
+	before := ringOwners(c, strategy, servers[:4], 5000)
+	after := ringOwners(c, strategy, servers, 5000)
+
+	moved := 0
+	for path, owner := range before {
+		if after[path] != owner {
+			c.Check(after[path], check.Equals, servers[4].Name)
+			moved++
+		}
+	}
+	c.Check(moved > 700 && moved < 1300, check.Equals, true, check.Commentf("moved %d", moved))
+}
+
+func (s *RingSuite) TestWeights(c *check.C) {
+	servers := testServers(true, true)
+	servers[0].Weight = 3
+	servers[1].Weight = 1
+	owners := ringOwners(c, newRing(c, StrategyOptions{VirtualNodes: 50}), servers, 4000)
+	counts := make(map[string]int)
+	for _, owner := range owners {
+		counts[owner]++
+	}
+	c.Check(counts[servers[0].Name] > 2600 && counts[servers[0].Name] < 3400, check.Equals, true,
+		check.Commentf("%v", counts))
+}
+
+func (s *RingSuite) TestRingIsCached(c *check.C) {
+	strategy := newRing(c, StrategyOptions{})
+	servers := testServers(true, true)
+	ring := strategy.currentRing(servers)
+	servers[0].IsAlive = false
+	c.Check(strategy.currentRing(servers), check.Equals, ring)
+	c.Check(strategy.currentRing(testServers(true, true, true)), check.Not(check.Equals), ring)
+}
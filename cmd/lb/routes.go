@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultPool names the pool of the top level of the config.
+const defaultPool = "default"
+
+// RouteConfig sends the requests matching all of its conditions to Pool, the
+// default pool if it is empty. Host is a glob like "*.example.com" matched
+// with path.Match against the host without the port, PathPrefix and
+// PathRegex are matched against the path, Methods lists the methods of the
+// route and Headers the values the request headers must have, any value if
+// it is empty. Conditions that are not set match every request. Rewrite
+// changes the requests of the route and their responses.
+type RouteConfig struct {
+	Host       string            `json:"host"`
+	PathPrefix string            `json:"pathPrefix"`
+	PathRegex  string            `json:"pathRegex"`
+	Methods    []string          `json:"methods"`
+	Headers    map[string]string `json:"headers"`
+	Pool       string            `json:"pool"`
+	Rewrite    RewriteConfig     `json:"rewrite"`
+
+	pathRegex *regexp.Regexp
+}
+
+func (c *RouteConfig) normalize() error {
+	if c.Pool == "" {
+		c.Pool = defaultPool
+	}
+	c.Host = strings.ToLower(c.Host)
+	if _, err := path.Match(c.Host, ""); err != nil {
+		return fmt.Errorf("invalid host pattern %s", c.Host)
+	}
+	if c.PathPrefix != "" && !strings.HasPrefix(c.PathPrefix, "/") {
+		return fmt.Errorf("path prefix %s does not start with /", c.PathPrefix)
+	}
+	c.pathRegex = nil
+	if c.PathRegex != "" {
+		regex, err := regexp.Compile(c.PathRegex)
+		if err != nil {
+			return fmt.Errorf("invalid path regex: %s", err)
+		}
+		c.pathRegex = regex
+	}
+	for i, method := range c.Methods {
+		c.Methods[i] = strings.ToUpper(method)
+	}
+	return c.Rewrite.normalize()
+}
+
+func (c *RouteConfig) matches(r *http.Request) bool {
+	if c.Host != "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if ok, _ := path.Match(c.Host, strings.ToLower(host)); !ok {
+			return false
+		}
+	}
+	if !strings.HasPrefix(r.URL.Path, c.PathPrefix) {
+		return false
+	}
+	if c.pathRegex != nil && !c.pathRegex.MatchString(r.URL.Path) {
+		return false
+	}
+	if len(c.Methods) > 0 {
+		found := false
+		for _, method := range c.Methods {
+			found = found || method == r.Method
+		}
+		if !found {
+			return false
+		}
+	}
+	for name, value := range c.Headers {
+		values, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok {
+			return false
+		}
+		if value == "" {
+			continue
+		}
+		found := false
+		for _, v := range values {
+			found = found || v == value
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// route is a route of the table with its pool.
+type route struct {
+	// requests is accessed atomically and goes first to stay 64-bit aligned.
+	requests uint64
+	config   RouteConfig
+	pool     *Pool
+}
+
+// count counts a request of the route and returns how many there were.
+func (rt *route) count() uint64 {
+	return atomic.AddUint64(&rt.requests, 1)
+}
+
+// routeTable chooses the route of every request, it is replaced as a whole
+// when the config changes.
+type routeTable struct {
+	mutex  sync.RWMutex
+	routes []*route
+}
+
+// configure makes the table send the requests matching routes to the pools
+// of the same name.
+func (t *routeTable) configure(routes []RouteConfig, pools map[string]*Pool) {
+	table := make([]*route, len(routes))
+	for i, config := range routes {
+		table[i] = &route{config: config, pool: pools[config.Pool]}
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.routes = table
+}
+
+// match returns the first route matching r, a route to fallback without
+// any rules if none does.
+func (t *routeTable) match(r *http.Request, fallback *Pool) *route {
+	if t != nil {
+		t.mutex.RLock()
+		defer t.mutex.RUnlock()
+		for _, rt := range t.routes {
+			if rt.config.matches(r) {
+				return rt
+			}
+		}
+	}
+	return &route{pool: fallback}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type RoutesSuite struct{}
+
+var _ = check.Suite(&RoutesSuite{})
+
+func (s *RoutesSuite) TestMatch(c *check.C) {
+	for _, t := range []struct {
+		route   RouteConfig
+		method  string
+		target  string
+		headers map[string]string
+		matches bool
+	}{
+		{RouteConfig{}, "GET", "/", nil, true},
+		{RouteConfig{Host: "*.example.com"}, "GET", "http://api.EXAMPLE.com:8080/", nil, true},
+		{RouteConfig{Host: "*.example.com"}, "GET", "http://example.com/", nil, false},
+		{RouteConfig{PathPrefix: "/db/"}, "GET", "/db/users", nil, true},
+		{RouteConfig{PathPrefix: "/db/"}, "GET", "/dbx", nil, false},
+		{RouteConfig{PathRegex: `^/api/v\d+/`}, "GET", "/api/v1/some-data", nil, true},
+		{RouteConfig{PathRegex: `^/api/v\d+/`}, "GET", "/api/latest/some-data", nil, false},
+		{RouteConfig{Methods: []string{"post", "put"}}, "PUT", "/", nil, true},
+		{RouteConfig{Methods: []string{"post", "put"}}, "GET", "/", nil, false},
+		{RouteConfig{Headers: map[string]string{"x-canary": ""}}, "GET", "/", map[string]string{"X-Canary": "yes"}, true},
+		{RouteConfig{Headers: map[string]string{"x-canary": "yes"}}, "GET", "/", map[string]string{"X-Canary": "no"}, false},
+		{RouteConfig{Headers: map[string]string{"x-canary": ""}}, "GET", "/", nil, false},
+	} {
+		c.Assert(t.route.normalize(), check.IsNil)
+		r := httptest.NewRequest(t.method, t.target, nil)
+		for name, value := range t.headers {
+			r.Header.Set(name, value)
+		}
+		c.Check(t.route.matches(r), check.Equals, t.matches, check.Commentf("%+v %s %s", t.route, t.method, t.target))
+	}
+}
+
+func (s *RoutesSuite) TestLoadConfig(c *check.C) {
+	config, err := LoadConfig(writeConfig(c, `{
+		"strategy": "round-robin",
+		"backends": [{"address": "server1:8080"}],
+		"pools": {
+			"db": {
+				"healthCheck": {"path": "/ready"},
+				"backends": [{"address": "db:8083"}]
+			}
+		},
+		"routes": [
+			{"pathPrefix": "/db/", "pool": "db"},
+			{"host": "*.example.com"}
+		]
+	}`))
+	c.Assert(err, check.IsNil)
+	c.Check(config.Strategy, check.Equals, "round-robin")
+	c.Check(config.Pools["db"].Strategy, check.Equals, "")
+	c.Check(config.Pools["db"].Backends[0].HealthPath, check.Equals, "/ready")
+	c.Check(config.Routes[1].Pool, check.Equals, defaultPool)
+
+	_, err = LoadConfig(writeConfig(c, `{"routes": [{"pool": "db"}]}`))
+	c.Check(err, check.ErrorMatches, "config: route 0: unknown pool db")
+	_, err = LoadConfig(writeConfig(c, `{"pools": {"default": {}}}`))
+	c.Check(err, check.ErrorMatches, `config: pool name "default" is reserved`)
+	_, err = LoadConfig(writeConfig(c, `{"pools": {"db": {"backends": [{}]}}}`))
+	c.Check(err, check.ErrorMatches, "config: pool db: backend 0 has no address")
+	_, err = LoadConfig(writeConfig(c, `{"routes": [{"pathRegex": "("}]}`))
+	c.Check(err, check.ErrorMatches, "config: route 0: invalid path regex: .*")
+}
+
+func (s *RoutesSuite) TestRouting(c *check.C) {
+	app, appAddress := testBackend(c, "app", 0)
+	defer app.Close()
+	db, dbAddress := testBackend(c, "db", 0)
+	defer db.Close()
+
+	config := &Config{
+		PoolConfig: PoolConfig{Backends: []BackendConfig{{Address: appAddress}}},
+		Pools: map[string]PoolConfig{
+			"db": {Strategy: "round-robin", Backends: []BackendConfig{{Address: dbAddress}}},
+		},
+		Routes: []RouteConfig{{PathPrefix: "/db/", Pool: "db"}},
+	}
+	c.Assert(config.normalize(), check.IsNil)
+	balancer, err := NewBalancer(config)
+	c.Assert(err, check.IsNil)
+	defer balancer.Stop()
+	pools := balancer.Pools()
+	c.Assert(pools, check.HasLen, 2)
+	c.Check(pools["db"].strategy, check.FitsTypeOf, &roundRobin{})
+	for _, pool := range pools {
+		pool := pool
+		waitFor(c, func() bool { return len(aliveIndexes(pool.Servers())) == 1 })
+	}
+	handler := &proxy{pool: balancer.pool, routes: balancer.routes}
+
+	c.Check(strings.Fields(serve(handler, "GET", "/db/users", "").Body.String())[0], check.Equals, "db")
+	c.Check(strings.Fields(serve(handler, "GET", "/api/v1/some-data", "").Body.String())[0], check.Equals, "app")
+
+	// Pools without routes are stopped.
+	config = &Config{PoolConfig: PoolConfig{Backends: []BackendConfig{{Address: appAddress}}}}
+	c.Assert(config.normalize(), check.IsNil)
+	c.Assert(balancer.Apply(config), check.IsNil)
+	c.Check(balancer.Pools(), check.HasLen, 1)
+	c.Check(pools["db"].Servers(), check.HasLen, 0)
+	c.Check(strings.Fields(serve(handler, "GET", "/db/users", "").Body.String())[0], check.Equals, "app")
+}
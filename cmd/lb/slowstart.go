@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// SlowStartConfig ramps up the share of requests of a backend that becomes
+// healthy again, after failing its health checks, being ejected or being
+// disabled. Its weight grows linearly from MinWeightPercent of the
+// configured one to all of it over Window. There is no slow start if Window
+// is zero.
+type SlowStartConfig struct {
+	Window           Duration `json:"window"`
+	MinWeightPercent int      `json:"minWeightPercent"`
+}
+
+func (c *SlowStartConfig) normalize() error {
+	if c.Window < 0 {
+		return fmt.Errorf("slow start window can not be negative")
+	}
+	if c.MinWeightPercent < 0 || c.MinWeightPercent > 100 {
+		return fmt.Errorf("slow start minimal weight must be between 0 and 100 percent")
+	}
+	if c.MinWeightPercent == 0 {
+		c.MinWeightPercent = 10
+	}
+	return nil
+}
+
+// ramp returns the share of its weight a backend healthy since since gets
+// at now, 0 if it is out of its slow start window.
+func (c *SlowStartConfig) ramp(since, now time.Time) float64 {
+	window := time.Duration(c.Window)
+	elapsed := now.Sub(since)
+	if window <= 0 || since.IsZero() || elapsed < 0 || elapsed >= window {
+		return 0
+	}
+	min := float64(c.MinWeightPercent) / 100
+	return min + (1-min)*float64(elapsed)/float64(window)
+}
+
+func (b *Backend) setSlowStart(config SlowStartConfig) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.slowStart = config
+}
+
+// rampLocked returns the share of its weight the backend gets at now, 0 if
+// it is out of its slow start window. The window starts when the backend
+// becomes healthy or its ejection ends, whatever is later.
+func (b *Backend) rampLocked(now time.Time) float64 {
+	since := b.healthySince
+	if b.ejectedUntil.After(since) {
+		since = b.ejectedUntil
+	}
+	return b.slowStart.ramp(since, now)
+}
+
+// effectiveWeight is the weight strategies balance by: the configured one,
+// at least 1, scaled down in the slow start window.
+func (s *Server) effectiveWeight() float64 {
+	weight := float64(s.Weight)
+	if weight < 1 {
+		weight = 1
+	}
+	if s.Ramp > 0 {
+		weight *= s.Ramp
+	}
+	return weight
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type SlowStartSuite struct{}
+
+var _ = check.Suite(&SlowStartSuite{})
+
+func (s *SlowStartSuite) TestNormalize(c *check.C) {
+	config := SlowStartConfig{}
+	c.Assert(config.normalize(), check.IsNil)
+	c.Check(config.MinWeightPercent, check.Equals, 10)
+
+	config = SlowStartConfig{Window: Duration(-time.Second)}
+	c.Check(config.normalize(), check.ErrorMatches, "slow start window can not be negative")
+	config = SlowStartConfig{MinWeightPercent: 101}
+	c.Check(config.normalize(), check.ErrorMatches, "slow start minimal weight .*")
+}
+
+func (s *SlowStartSuite) TestRamp(c *check.C) {
+	config := SlowStartConfig{Window: Duration(10 * time.Second), MinWeightPercent: 50}
+	since := time.Now()
+	c.Check(config.ramp(since, since), check.Equals, 0.5)
+	c.Check(config.ramp(since, since.Add(5*time.Second)), check.Equals, 0.75)
+	c.Check(config.ramp(since, since.Add(10*time.Second)), check.Equals, 0.0)
+	c.Check(config.ramp(time.Time{}, since), check.Equals, 0.0)
+
+	config.Window = 0
+	c.Check(config.ramp(since, since), check.Equals, 0.0)
+}
+
+func (s *SlowStartSuite) TestRecovery(c *check.C) {
+	config := testBackendConfig("server1:8080")
+	config.Weight = 4
+	b := newBackend(config, nil)
+	b.setSlowStart(SlowStartConfig{Window: Duration(time.Hour), MinWeightPercent: 10})
+	stop := make(chan struct{})
+	b.stop = stop
+
+	// A backend that is healthy from the start gets all of its weight.
+	b.record(stop, time.Now(), 0, nil)
+	server := b.Snapshot()
+	c.Check(server.effectiveWeight(), check.Equals, 4.0)
+
+	b.record(stop, time.Now(), 0, fmt.Errorf("unexpected status 500"))
+	c.Check(b.Snapshot().IsAlive, check.Equals, false)
+	b.record(stop, time.Now(), 0, nil)
+	server = b.Snapshot()
+	c.Check(server.IsAlive, check.Equals, true)
+	c.Check(server.Ramp > 0.09 && server.Ramp < 0.11, check.Equals, true, check.Commentf("%v", server.Ramp))
+	c.Check(server.effectiveWeight() < 0.5, check.Equals, true)
+}
+
+func (s *SlowStartSuite) TestRampAccepts(c *check.C) {
+	accepted := 0
+	for i := 0; i < 10000; i++ {
+		h := hash64(fmt.Sprintf("/key/%d", i))
+		if rampAccepts(h, 0.25) {
+			accepted++
+			c.Check(rampAccepts(h, 0.5), check.Equals, true)
+		}
+		c.Check(rampAccepts(h, 0), check.Equals, true)
+	}
+	c.Check(accepted > 2200 && accepted < 2800, check.Equals, true, check.Commentf("accepted %d", accepted))
+}
+
+func (s *SlowStartSuite) TestRampingServerGetsFewerKeys(c *check.C) {
+	servers := testServers(true, true)
+	servers[1].Ramp = 0.1
+	for _, strategy := range []Strategy{pathHash{}, newRing(c, StrategyOptions{})} {
+		owners := ringOwners(c, strategy, servers, 2000)
+		counts := make(map[string]int)
+		for _, owner := range owners {
+			counts[owner]++
+		}
+		c.Check(counts[servers[1].Name] < 200, check.Equals, true, check.Commentf("%v", counts))
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// StickyConfig pins clients to backends with a cookie. The response to a
+// client without a valid cookie sets Cookie to identify the backend that
+// served it, later requests with the cookie go to the same backend as long as
+// it is alive, otherwise the strategy chooses a new one and the cookie is
+// replaced. The cookie is an HMAC of the backend address keyed with Secret,
+// so it neither reveals the address nor can be forged; without a Secret a
+// random key is used, which changes when the balancer restarts. The cookie
+// expires after MaxAge, with the browser session if it is zero.
+type StickyConfig struct {
+	Enabled bool     `json:"enabled"`
+	Cookie  string   `json:"cookie"`
+	Secret  string   `json:"secret"`
+	MaxAge  Duration `json:"maxAge"`
+}
+
+func (c *StickyConfig) normalize() error {
+	if c.Cookie == "" {
+		c.Cookie = "lb_backend"
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("sticky session max age can not be negative")
+	}
+	return nil
+}
+
+// stickiness is a StickyConfig with the key signing its cookies.
+type stickiness struct {
+	StickyConfig
+	key []byte
+	// fallbackKey is used without a secret.
+	fallbackKey []byte
+}
+
+func randomKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func newStickiness(config StickyConfig, fallbackKey []byte) stickiness {
+	key := fallbackKey
+	if config.Secret != "" {
+		key = []byte(config.Secret)
+	}
+	return stickiness{StickyConfig: config, key: key, fallbackKey: fallbackKey}
+}
+
+// token returns the cookie value identifying the backend with address.
+func (s stickiness) token(address string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(address))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// pinned returns the alive server of servers the cookie of r identifies, nil
+// if there is none or it is in exclude.
+func (s stickiness) pinned(r *http.Request, servers []Server, exclude []string) *Server {
+	cookie, err := r.Cookie(s.Cookie)
+	if err != nil {
+		return nil
+	}
+	for i := range servers {
+		if !hmac.Equal([]byte(cookie.Value), []byte(s.token(servers[i].Name))) {
+			continue
+		}
+		if !servers[i].IsAlive {
+			return nil
+		}
+		for _, name := range exclude {
+			if name == servers[i].Name {
+				return nil
+			}
+		}
+		return &servers[i]
+	}
+	return nil
+}
+
+// stick sets the cookie pinning the client of r to dst, unless it is set
+// already.
+func (s stickiness) stick(rw http.ResponseWriter, r *http.Request, dst Server) {
+	if !s.Enabled {
+		return
+	}
+	token := s.token(dst.Name)
+	if cookie, err := r.Cookie(s.Cookie); err == nil && cookie.Value == token {
+		return
+	}
+	cookie := &http.Cookie{
+		Name:     s.Cookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if s.MaxAge > 0 {
+		cookie.MaxAge = seconds(time.Duration(s.MaxAge))
+		cookie.Expires = time.Now().Add(time.Duration(s.MaxAge))
+	}
+	http.SetCookie(rw, cookie)
+}
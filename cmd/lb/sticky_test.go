@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type StickySuite struct{}
+
+var _ = check.Suite(&StickySuite{})
+
+func stickyRequest(cookie *http.Cookie) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	return r
+}
+
+func responseCookie(rw *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range rw.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func (s *StickySuite) TestSessions(c *check.C) {
+	first, firstAddress := testBackend(c, "first", 0)
+	defer first.Close()
+	second, secondAddress := testBackend(c, "second", 0)
+	defer second.Close()
+	pool := testPool(c, &roundRobin{}, firstAddress, secondAddress)
+	defer pool.Stop()
+	config := StickyConfig{Enabled: true, MaxAge: Duration(time.Hour)}
+	c.Assert(config.normalize(), check.IsNil)
+	pool.SetSticky(config)
+	handler := &proxy{pool: pool}
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, stickyRequest(nil))
+	cookie := responseCookie(rw, "lb_backend")
+	c.Assert(cookie, check.NotNil)
+	c.Check(cookie.HttpOnly, check.Equals, true)
+	c.Check(cookie.MaxAge, check.Equals, 3600)
+	pinned := strings.Fields(rw.Body.String())[0]
+
+	// The round robin would alternate, the cookie keeps the client on the
+	// same backend and is not set again.
+	for i := 0; i < 3; i++ {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, stickyRequest(cookie))
+		c.Check(strings.Fields(rw.Body.String())[0], check.Equals, pinned)
+		c.Check(rw.Header().Get("Set-Cookie"), check.Equals, "")
+	}
+
+	// A forged cookie is ignored and replaced.
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, stickyRequest(&http.Cookie{Name: "lb_backend", Value: firstAddress}))
+	c.Check(responseCookie(rw, "lb_backend"), check.NotNil)
+
+	// The client moves on once its backend is gone.
+	pinnedAddress, otherName := firstAddress, "second"
+	if pinned == "second" {
+		pinnedAddress, otherName = secondAddress, "first"
+	}
+	c.Assert(pool.SetMode(pinnedAddress, ModeDraining), check.IsNil)
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, stickyRequest(cookie))
+	c.Check(strings.Fields(rw.Body.String())[0], check.Equals, otherName)
+	moved := responseCookie(rw, "lb_backend")
+	c.Assert(moved, check.NotNil)
+	c.Check(moved.Value, check.Not(check.Equals), cookie.Value)
+}
+
+func (s *StickySuite) TestSecret(c *check.C) {
+	config := StickyConfig{Enabled: true, Secret: "secret"}
+	c.Assert(config.normalize(), check.IsNil)
+	c.Check(newStickiness(config, randomKey()).token("server1:8080"),
+		check.Equals, newStickiness(config, randomKey()).token("server1:8080"))
+
+	config.Secret = ""
+	c.Check(newStickiness(config, randomKey()).token("server1:8080"),
+		check.Not(check.Equals), newStickiness(config, randomKey()).token("server1:8080"))
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultStrategy = "consistent-hash"
+
+var errNoAlive = fmt.Errorf("balancer: no alive servers found")
+
+// Strategy chooses the backend a request is forwarded to. servers is a
+// snapshot of the pool and Pick must return a pointer into it or an error if
+// there is no suitable backend.
+type Strategy interface {
+	Pick(r *http.Request, servers []Server) (*Server, error)
+}
+
+// StrategyOptions are the tunables shared by all strategies, each strategy
+// uses only the ones relevant to it.
+type StrategyOptions struct {
+	// VirtualNodes is the number of ring points per unit of backend weight.
+	VirtualNodes int
+	// HashKey is the KeyExpr hash based strategies compute affinity from.
+	HashKey string
+}
+
+var strategies = map[string]func(StrategyOptions) (Strategy, error){
+	"consistent-hash": newConsistentHash,
+	"path-hash":       newPathHash,
+	"round-robin": func(StrategyOptions) (Strategy, error) {
+		return &roundRobin{}, nil
+	},
+	"random": func(StrategyOptions) (Strategy, error) {
+		return random{}, nil
+	},
+	"least-connections": func(StrategyOptions) (Strategy, error) {
+		return leastConnections{}, nil
+	},
+	"power-of-two-choices": func(StrategyOptions) (Strategy, error) {
+		return powerOfTwoChoices{}, nil
+	},
+}
+
+// strategyName resolves the empty name to the default strategy.
+func strategyName(name string) string {
+	if name == "" {
+		return defaultStrategy
+	}
+	return name
+}
+
+func NewStrategy(name string, options StrategyOptions) (Strategy, error) {
+	name = strategyName(name)
+	constructor, ok := strategies[name]
+	if !ok {
+		return nil, fmt.Errorf("balancer: unknown strategy %s", name)
+	}
+	return constructor(options)
+}
+
+func StrategyNames() []string {
+	names := make([]string, 0, len(strategies))
+	for name := range strategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func aliveIndexes(servers []Server) []int {
+	indexes := make([]int, 0, len(servers))
+	for i := range servers {
+		if servers[i].IsAlive {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+func chooseServer(serversPool []Server, url *url.URL) (*uint64, error) {
+	return chooseServerByKey(serversPool, url.Path)
+}
+
+// rampAccepts decides whether a backend in its slow start window takes the
+// key with hash h. The share of keys it takes grows with ramp and a key it
+// takes at one ramp it takes at all higher ones.
+func rampAccepts(h uint64, ramp float64) bool {
+	if ramp <= 0 {
+		return true
+	}
+	return float64(mix64(h^0x9e3779b97f4a7c15)>>11)/(1<<53) < ramp
+}
+
+// chooseServerByKey maps the hash of key onto the backends, each owning a
+// number of slots equal to its weight. When the owner is dead, or ramping
+// up and not taking the key yet, the next alive backend in the pool gets it.
+func chooseServerByKey(serversPool []Server, key string) (*uint64, error) {
+	if len(serversPool) == 0 {
+		return nil, errNoAlive
+	}
+	slots := uint64(0)
+	for i := range serversPool {
+		slots += uint64(weightSlots(&serversPool[i]))
+	}
+	h := hash64(key)
+	slot := h % slots
+	index := uint64(0)
+	for slot >= uint64(weightSlots(&serversPool[index])) {
+		slot -= uint64(weightSlots(&serversPool[index]))
+		index++
+	}
+	fallback := -1
+	for i := 0; i < len(serversPool); i++ {
+		if s := &serversPool[index]; s.IsAlive {
+			if rampAccepts(h, s.Ramp) {
+				return &index, nil
+			}
+			if fallback < 0 {
+				fallback = int(index)
+			}
+		}
+		index = (index + 1) % uint64(len(serversPool))
+	}
+	if fallback < 0 {
+		return nil, errNoAlive
+	}
+	index = uint64(fallback)
+	return &index, nil
+}
+
+// weightSlots returns the configured weight of s, at least 1.
+func weightSlots(s *Server) int {
+	if s.Weight < 1 {
+		return 1
+	}
+	return s.Weight
+}
+
+// pathHash sends all requests with the same key, the path by default, to the
+// same backend. When the backend is dead its requests go to the next alive
+// one in the pool.
+type pathHash struct {
+	key KeyExpr
+}
+
+func newPathHash(options StrategyOptions) (Strategy, error) {
+	key, err := ParseKeyExpr(options.HashKey)
+	if err != nil {
+		return nil, err
+	}
+	return pathHash{key: key}, nil
+}
+
+func (s pathHash) Pick(r *http.Request, servers []Server) (*Server, error) {
+	index, err := chooseServerByKey(servers, s.key.Key(r))
+	if err != nil {
+		return nil, err
+	}
+	return &servers[*index], nil
+}
+
+// roundRobin cycles through the alive backends. Backends of different
+// effective weights get shares of the requests proportional to them, spread
+// out evenly with the smooth weighted round robin of nginx.
+type roundRobin struct {
+	next uint64
+
+	mutex   sync.Mutex
+	current map[string]float64
+}
+
+func (s *roundRobin) Pick(_ *http.Request, servers []Server) (*Server, error) {
+	alive := aliveIndexes(servers)
+	if len(alive) == 0 {
+		return nil, errNoAlive
+	}
+	if !equalWeights(servers, alive) {
+		return s.pickWeighted(servers, alive), nil
+	}
+	n := atomic.AddUint64(&s.next, 1) - 1
+	return &servers[alive[n%uint64(len(alive))]], nil
+}
+
+func (s *roundRobin) pickWeighted(servers []Server, alive []int) *Server {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.current == nil || len(s.current) > len(servers) {
+		// Drop the removed backends.
+		current := make(map[string]float64, len(servers))
+		for i := range servers {
+			current[servers[i].Name] = s.current[servers[i].Name]
+		}
+		s.current = current
+	}
+	var best *Server
+	total := 0.0
+	for _, i := range alive {
+		weight := servers[i].effectiveWeight()
+		total += weight
+		s.current[servers[i].Name] += weight
+		if best == nil || s.current[servers[i].Name] > s.current[best.Name] {
+			best = &servers[i]
+		}
+	}
+	s.current[best.Name] -= total
+	return best
+}
+
+func equalWeights(servers []Server, alive []int) bool {
+	for _, i := range alive[1:] {
+		if servers[i].effectiveWeight() != servers[alive[0]].effectiveWeight() {
+			return false
+		}
+	}
+	return true
+}
+
+// weightedRandom returns one of the alive servers not in skip, chosen with
+// a probability proportional to its effective weight.
+func weightedRandom(servers []Server, alive []int, skip *Server) *Server {
+	total := 0.0
+	for _, i := range alive {
+		if &servers[i] != skip {
+			total += servers[i].effectiveWeight()
+		}
+	}
+	point := rand.Float64() * total
+	var last *Server
+	for _, i := range alive {
+		if &servers[i] == skip {
+			continue
+		}
+		last = &servers[i]
+		point -= last.effectiveWeight()
+		if point < 0 {
+			break
+		}
+	}
+	return last
+}
+
+type random struct{}
+
+func (random) Pick(_ *http.Request, servers []Server) (*Server, error) {
+	alive := aliveIndexes(servers)
+	if len(alive) == 0 {
+		return nil, errNoAlive
+	}
+	return weightedRandom(servers, alive, nil), nil
+}
+
+// load is the number of in-flight requests of s with one more, per unit of
+// its effective weight.
+func load(s *Server) float64 {
+	return float64(s.ActiveConnections()+1) / s.effectiveWeight()
+}
+
+// leastConnections picks the backend with the lowest load, breaking ties
+// randomly.
+type leastConnections struct{}
+
+func (leastConnections) Pick(_ *http.Request, servers []Server) (*Server, error) {
+	var best *Server
+	bestLoad := 0.0
+	ties := 0
+	for i := range servers {
+		s := &servers[i]
+		if !s.IsAlive {
+			continue
+		}
+		switch l := load(s); {
+		case best == nil || l < bestLoad:
+			best, bestLoad, ties = s, l, 1
+		case l == bestLoad:
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = s
+			}
+		}
+	}
+	if best == nil {
+		return nil, errNoAlive
+	}
+	return best, nil
+}
+
+// powerOfTwoChoices picks two random backends, weighted by their effective
+// weights, and takes the less loaded one.
+type powerOfTwoChoices struct{}
+
+func (powerOfTwoChoices) Pick(_ *http.Request, servers []Server) (*Server, error) {
+	alive := aliveIndexes(servers)
+	switch len(alive) {
+	case 0:
+		return nil, errNoAlive
+	case 1:
+		return &servers[alive[0]], nil
+	}
+	a := weightedRandom(servers, alive, nil)
+	b := weightedRandom(servers, alive, a)
+	if load(b) < load(a) {
+		return b, nil
+	}
+	return a, nil
+}
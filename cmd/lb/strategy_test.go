@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http/httptest"
+
+	"gopkg.in/check.v1"
+)
+
+type StrategySuite struct{}
+
+var _ = check.Suite(&StrategySuite{})
+
+func testServers(alive ...bool) []Server {
+	servers := make([]Server, len(alive))
+	for i := range servers {
+		servers[i] = Server{
+			Name:    string(rune('a'+i)) + ":8080",
+			IsAlive: alive[i],
+			backend: &Backend{},
+		}
+	}
+	return servers
+}
+
+func pickCounts(c *check.C, strategy Strategy, servers []Server, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		server, err := strategy.Pick(httptest.NewRequest("GET", "/", nil), servers)
+		c.Assert(err, check.IsNil)
+		counts[server.Name]++
+	}
+	return counts
+}
+
+func (s *StrategySuite) TestNewStrategy(c *check.C) {
+	for _, name := range StrategyNames() {
+		strategy, err := NewStrategy(name, StrategyOptions{})
+		c.Check(err, check.IsNil)
+		c.Check(strategy, check.NotNil)
+	}
+	strategy, err := NewStrategy("", StrategyOptions{})
+	c.Check(err, check.IsNil)
+	c.Check(strategy, check.FitsTypeOf, &consistentHash{})
+
+	_, err = NewStrategy("unknown", StrategyOptions{})
+	c.Check(err, check.ErrorMatches, "balancer: unknown strategy unknown")
+}
+
+func (s *StrategySuite) TestNoAlive(c *check.C) {
+	for _, name := range StrategyNames() {
+		strategy, _ := NewStrategy(name, StrategyOptions{})
+		_, err := strategy.Pick(httptest.NewRequest("GET", "/", nil), testServers(false, false))
+		c.Check(err, check.Equals, errNoAlive, check.Commentf(name))
+		_, err = strategy.Pick(httptest.NewRequest("GET", "/", nil), nil)
+		c.Check(err, check.Equals, errNoAlive, check.Commentf(name))
+	}
+}
+
+func (s *StrategySuite) TestRoundRobin(c *check.C) {
+	counts := pickCounts(c, &roundRobin{}, testServers(true, false, true, true), 300)
+	c.Check(counts, check.DeepEquals, map[string]int{"a:8080": 100, "c:8080": 100, "d:8080": 100})
+}
+
+func (s *StrategySuite) TestRandom(c *check.C) {
+	counts := pickCounts(c, random{}, testServers(true, true, false), 1000)
+	c.Check(counts, check.HasLen, 2)
+	c.Check(counts["a:8080"] > 350 && counts["b:8080"] > 350, check.Equals, true)
+}
+
+func (s *StrategySuite) TestLeastConnections(c *check.C) {
+	servers := testServers(true, true, true, false)
+	servers[0].backend.active = 3
+	servers[1].backend.active = 1
+	servers[2].backend.active = 2
+	counts := pickCounts(c, leastConnections{}, servers, 10)
+	c.Check(counts, check.DeepEquals, map[string]int{"b:8080": 10})
+
+	servers[0].backend.active = 1
+	counts = pickCounts(c, leastConnections{}, servers, 1000)
+	c.Check(counts, check.HasLen, 2)
+	c.Check(counts["a:8080"] > 350 && counts["b:8080"] > 350, check.Equals, true)
+}
+
+func (s *StrategySuite) TestPowerOfTwoChoices(c *check.C) {
+	servers := testServers(true, true, true)
+	servers[0].backend.active = 10
+	counts := pickCounts(c, powerOfTwoChoices{}, servers, 1000)
+	c.Check(counts["a:8080"], check.Equals, 0)
+
+	counts = pickCounts(c, powerOfTwoChoices{}, testServers(false, true), 10)
+	c.Check(counts, check.DeepEquals, map[string]int{"b:8080": 10})
+}
+
+func (s *StrategySuite) TestPathHash(c *check.C) {
+	servers := testServers(true, true, true)
+	first, err := pathHash{}.Pick(httptest.NewRequest("GET", "/some/path", nil), servers)
+	c.Assert(err, check.IsNil)
+	for i := 0; i < 10; i++ {
+		server, err := pathHash{}.Pick(httptest.NewRequest("GET", "/some/path", nil), servers)
+		c.Assert(err, check.IsNil)
+		c.Check(server, check.Equals, first)
+	}
+}
+
+func (s *StrategySuite) TestWeights(c *check.C) {
+	servers := testServers(true, true)
+	servers[0].Weight = 3
+	servers[1].Weight = 1
+	counts := pickCounts(c, &roundRobin{}, servers, 400)
+	c.Check(counts, check.DeepEquals, map[string]int{"a:8080": 300, "b:8080": 100})
+
+	counts = pickCounts(c, random{}, servers, 4000)
+	c.Check(counts["a:8080"] > 2700 && counts["a:8080"] < 3300, check.Equals, true, check.Commentf("%v", counts))
+
+	owners := ringOwners(c, pathHash{}, servers, 4000)
+	counts = make(map[string]int)
+	for _, owner := range owners {
+		counts[owner]++
+	}
+	c.Check(counts["a:8080"] > 2700 && counts["a:8080"] < 3300, check.Equals, true, check.Commentf("%v", counts))
+
+	// Two in-flight requests per three units of weight are less than one
+	// per unit.
+	servers[0].backend.active = 1
+	counts = pickCounts(c, leastConnections{}, servers, 10)
+	c.Check(counts, check.DeepEquals, map[string]int{"a:8080": 10})
+}
+
+func (s *StrategySuite) TestSmoothRoundRobin(c *check.C) {
+	servers := testServers(true, true, true)
+	servers[0].Weight = 5
+	strategy := &roundRobin{}
+	var order []string
+	for i := 0; i < 7; i++ {
+		server, err := strategy.Pick(httptest.NewRequest("GET", "/", nil), servers)
+		c.Assert(err, check.IsNil)
+		order = append(order, server.Name[:1])
+	}
+	c.Check(order, check.DeepEquals, []string{"a", "a", "b", "a", "c", "a", "a"})
+}
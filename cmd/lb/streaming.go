@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StreamingConfig controls how responses are streamed to clients. Data
+// received from a backend is flushed to the client at most FlushInterval
+// later, right away if the interval is negative or the response is a
+// text/event-stream. WriteTimeout bounds the time to forward a response,
+// WriteTimeouts override it for paths starting with their prefixes, the
+// longest prefix wins. A negative timeout means no limit, for long-lived
+// streams.
+type StreamingConfig struct {
+	FlushInterval Duration             `json:"flushInterval"`
+	WriteTimeout  Duration             `json:"writeTimeout"`
+	WriteTimeouts []WriteTimeoutConfig `json:"writeTimeouts"`
+}
+
+type WriteTimeoutConfig struct {
+	PathPrefix string   `json:"pathPrefix"`
+	Timeout    Duration `json:"timeout"`
+}
+
+func (c *StreamingConfig) normalize() error {
+	if c.FlushInterval == 0 {
+		c.FlushInterval = Duration(100 * time.Millisecond)
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = Duration(10 * time.Second)
+	}
+	for i, route := range c.WriteTimeouts {
+		if !strings.HasPrefix(route.PathPrefix, "/") {
+			return fmt.Errorf("write timeout %d has path prefix not starting with /", i)
+		}
+		if route.Timeout == 0 {
+			return fmt.Errorf("write timeout %d for %s has no timeout", i, route.PathPrefix)
+		}
+	}
+	return nil
+}
+
+// writeTimeout returns the write timeout for the requests of path.
+func (c *StreamingConfig) writeTimeout(path string) time.Duration {
+	timeout, longest := c.WriteTimeout, -1
+	for _, route := range c.WriteTimeouts {
+		if strings.HasPrefix(path, route.PathPrefix) && len(route.PathPrefix) > longest {
+			timeout, longest = route.Timeout, len(route.PathPrefix)
+		}
+	}
+	return time.Duration(timeout)
+}
+
+type clientConnKey struct{}
+
+// withClientConn attaches the client connection to the context of its
+// requests, so setWriteDeadline can reach it. It is meant for
+// http.Server.ConnContext.
+func withClientConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, clientConnKey{}, conn)
+}
+
+// setWriteDeadline limits the time to write the response to r to timeout,
+// lifts the limit if timeout is negative. The server has no write timeout
+// of its own, so the deadline is set for every request; nothing is done if
+// the connection was not attached with withClientConn.
+func setWriteDeadline(r *http.Request, timeout time.Duration) {
+	conn, ok := r.Context().Value(clientConnKey{}).(net.Conn)
+	if !ok {
+		return
+	}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	conn.SetWriteDeadline(deadline)
+}
+
+// flushInterval returns how long data of resp may wait before it is flushed
+// to the client.
+func (c *StreamingConfig) flushInterval(resp *http.Response) time.Duration {
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if contentType == "text/event-stream" {
+		return -1
+	}
+	return time.Duration(c.FlushInterval)
+}
+
+// flushWriter flushes what was written to it after at most interval.
+type flushWriter struct {
+	writer   io.Writer
+	flusher  http.Flusher
+	interval time.Duration
+
+	mutex   sync.Mutex
+	timer   *time.Timer
+	pending bool
+}
+
+// newFlushWriter returns a flushWriter for rw, it only writes if rw can not
+// be flushed.
+func newFlushWriter(rw http.ResponseWriter, interval time.Duration) *flushWriter {
+	flusher, _ := rw.(http.Flusher)
+	return &flushWriter{writer: rw, flusher: flusher, interval: interval}
+}
+
+func (w *flushWriter) Write(data []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	n, err := w.writer.Write(data)
+	if err != nil || w.flusher == nil {
+		return n, err
+	}
+	if w.interval < 0 {
+		w.flusher.Flush()
+		return n, nil
+	}
+	if !w.pending {
+		w.pending = true
+		if w.timer == nil {
+			w.timer = time.AfterFunc(w.interval, w.delayedFlush)
+		} else {
+			w.timer.Reset(w.interval)
+		}
+	}
+	return n, nil
+}
+
+func (w *flushWriter) delayedFlush() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.pending {
+		w.flusher.Flush()
+		w.pending = false
+	}
+}
+
+// stop cancels the pending flush, the handler flushes everything when it
+// returns anyway.
+func (w *flushWriter) stop() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.pending = false
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// tryContext is the context of a single try of a request. It is cancelled
+// if the response headers do not arrive within the per-try timeout; the
+// body may take as long as the write timeout of the request allows.
+type tryContext struct {
+	context.Context
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	expired int32
+}
+
+func newTryContext(parent context.Context, timeout time.Duration) *tryContext {
+	ctx, cancel := context.WithCancel(parent)
+	t := &tryContext{Context: ctx, cancel: cancel}
+	t.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&t.expired, 1)
+		cancel()
+	})
+	return t
+}
+
+// received stops the per-try timer once the response headers arrived.
+func (t *tryContext) received() {
+	t.timer.Stop()
+}
+
+// wrap reports a failure caused by the per-try timer as a timeout.
+func (t *tryContext) wrap(err error) error {
+	if err != nil && atomic.LoadInt32(&t.expired) == 1 {
+		return fmt.Errorf("%s: %w", err, context.DeadlineExceeded)
+	}
+	return err
+}
+
+func (t *tryContext) Close() {
+	t.timer.Stop()
+	t.cancel()
+}
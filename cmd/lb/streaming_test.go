@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type StreamingSuite struct{}
+
+var _ = check.Suite(&StreamingSuite{})
+
+// streamingBackend writes the lines one by one, flushing each and waiting
+// for next before writing the following one.
+func streamingBackend(contentType string, next <-chan struct{}, lines ...string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", contentType)
+		for i, line := range lines {
+			if i > 0 {
+				select {
+				case <-next:
+				case <-r.Context().Done():
+					return
+				}
+			}
+			fmt.Fprintln(rw, line)
+			rw.(http.Flusher).Flush()
+		}
+	}))
+}
+
+func streamingProxy(c *check.C, config StreamingConfig, address string) (*Pool, *httptest.Server) {
+	c.Assert(config.normalize(), check.IsNil)
+	pool := testPool(c, &roundRobin{}, address)
+	pool.SetStreaming(config)
+	frontend := httptest.NewUnstartedServer(&proxy{pool: pool})
+	frontend.Config.ConnContext = withClientConn
+	frontend.Start()
+	return pool, frontend
+}
+
+func (s *StreamingSuite) TestWriteTimeout(c *check.C) {
+	config := StreamingConfig{WriteTimeouts: []WriteTimeoutConfig{
+		{PathPrefix: "/events", Timeout: -1},
+		{PathPrefix: "/events/slow", Timeout: Duration(time.Minute)},
+	}}
+	c.Assert(config.normalize(), check.IsNil)
+	c.Check(config.writeTimeout("/api"), check.Equals, 10*time.Second)
+	c.Check(config.writeTimeout("/events/1"), check.Equals, time.Duration(-1))
+	c.Check(config.writeTimeout("/events/slow/1"), check.Equals, time.Minute)
+
+	invalid := StreamingConfig{WriteTimeouts: []WriteTimeoutConfig{{PathPrefix: "events", Timeout: -1}}}
+	c.Check(invalid.normalize(), check.NotNil)
+}
+
+func (s *StreamingSuite) TestEventStream(c *check.C) {
+	next := make(chan struct{})
+	backend := streamingBackend("text/event-stream", next, "data: 1", "data: 2")
+	defer backend.Close()
+	pool, frontend := streamingProxy(c, StreamingConfig{FlushInterval: Duration(time.Hour)}, backend.Listener.Addr().String())
+	defer pool.Stop()
+	defer frontend.Close()
+
+	resp, err := http.Get(frontend.URL)
+	c.Assert(err, check.IsNil)
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	c.Assert(err, check.IsNil)
+	c.Check(line, check.Equals, "data: 1\n")
+	next <- struct{}{}
+	line, err = reader.ReadString('\n')
+	c.Assert(err, check.IsNil)
+	c.Check(line, check.Equals, "data: 2\n")
+}
+
+func (s *StreamingSuite) TestFlushInterval(c *check.C) {
+	next := make(chan struct{})
+	backend := streamingBackend("text/plain", next, "1", "2")
+	defer backend.Close()
+	pool, frontend := streamingProxy(c, StreamingConfig{FlushInterval: Duration(10 * time.Millisecond)}, backend.Listener.Addr().String())
+	defer pool.Stop()
+	defer frontend.Close()
+
+	resp, err := http.Get(frontend.URL)
+	c.Assert(err, check.IsNil)
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	c.Assert(err, check.IsNil)
+	c.Check(line, check.Equals, "1\n")
+	close(next)
+}
+
+func (s *StreamingSuite) TestLongStream(c *check.C) {
+	next := make(chan struct{})
+	backend := streamingBackend("text/plain", next, "1", "2", "3")
+	defer backend.Close()
+	config := StreamingConfig{WriteTimeouts: []WriteTimeoutConfig{{PathPrefix: "/short", Timeout: Duration(300 * time.Millisecond)}}}
+	pool, frontend := streamingProxy(c, config, backend.Listener.Addr().String())
+	defer pool.Stop()
+	defer frontend.Close()
+	retry := RetryConfig{PerTryTimeout: Duration(20 * time.Millisecond)}
+	c.Assert(retry.normalize(), check.IsNil)
+	pool.SetRetry(retry)
+
+	// The per-try timeout does not cut the body.
+	go func() {
+		for i := 0; i < 2; i++ {
+			time.Sleep(30 * time.Millisecond)
+			next <- struct{}{}
+		}
+	}()
+	resp, err := http.Get(frontend.URL + "/long")
+	c.Assert(err, check.IsNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Check(err, check.IsNil)
+	c.Check(string(body), check.Equals, "1\n2\n3\n")
+
+	// The write timeout of the route does.
+	resp, err = http.Get(frontend.URL + "/short")
+	c.Assert(err, check.IsNil)
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Check(err, check.NotNil)
+	c.Check(string(body), check.Equals, "1\n")
+}
+
+func (s *StreamingSuite) TestClientStopsReading(c *check.C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		chunk := make([]byte, 32<<10)
+		for {
+			if _, err := rw.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	defer backend.Close()
+	config := StreamingConfig{WriteTimeout: Duration(200 * time.Millisecond)}
+	c.Assert(config.normalize(), check.IsNil)
+	pool := testPool(c, &roundRobin{}, backend.Listener.Addr().String())
+	defer pool.Stop()
+	pool.SetStreaming(config)
+	handler := &proxy{pool: pool}
+	done := make(chan struct{})
+	frontend := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		handler.ServeHTTP(rw, r)
+	}))
+	frontend.Config.ConnContext = withClientConn
+	frontend.Start()
+	defer frontend.Close()
+
+	conn, err := net.Dial("tcp", frontend.Listener.Addr().String())
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: lb.test\r\n\r\n")
+
+	// The client reads nothing, the write deadline still ends the response.
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		c.Fatal("The response to a client that stopped reading was not cut off")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig sets up TLS termination on the frontend. It is on when there
+// are Certificates; the one presented to a client is chosen by the server
+// name it asks for, falling back to the first one. Clients have to support
+// at least MinVersion: "1.0", "1.1", "1.2" or "1.3". The certificate files
+// are read again on every config reload.
+type TLSConfig struct {
+	Certificates []CertificateConfig `json:"certificates"`
+	MinVersion   string              `json:"minVersion"`
+}
+
+type CertificateConfig struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+}
+
+func (c *TLSConfig) normalize() error {
+	if c.MinVersion == "" {
+		c.MinVersion = "1.2"
+	}
+	if _, ok := tlsVersions[c.MinVersion]; !ok {
+		return fmt.Errorf("unknown TLS version %s", c.MinVersion)
+	}
+	for i, certificate := range c.Certificates {
+		if certificate.CertFile == "" || certificate.KeyFile == "" {
+			return fmt.Errorf("certificate %d needs both a cert and a key file", i)
+		}
+	}
+	return nil
+}
+
+func (c *TLSConfig) Enabled() bool {
+	return len(c.Certificates) > 0
+}
+
+// certStore holds the certificates of the frontend, so they can be replaced
+// without restarting it.
+type certStore struct {
+	mutex        sync.RWMutex
+	loaded       bool
+	enabled      bool
+	certificates []tls.Certificate
+	minVersion   uint16
+}
+
+// certSet is what a TLS config is loaded into before it replaces the
+// current one.
+type certSet struct {
+	enabled      bool
+	certificates []tls.Certificate
+	minVersion   uint16
+}
+
+// read reads the certificates of config. TLS can not be turned on or off
+// once the frontend is started.
+func (s *certStore) read(config TLSConfig) (*certSet, error) {
+	s.mutex.RLock()
+	loaded, enabled := s.loaded, s.enabled
+	s.mutex.RUnlock()
+	if loaded && config.Enabled() != enabled {
+		return nil, fmt.Errorf("TLS can not be turned on or off without a restart")
+	}
+	certificates := make([]tls.Certificate, len(config.Certificates))
+	for i, files := range config.Certificates {
+		certificate, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load certificate %s: %s", files.CertFile, err)
+		}
+		// The leaf is needed to choose the certificate by the server name.
+		certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate %s: %s", files.CertFile, err)
+		}
+		certificates[i] = certificate
+	}
+	return &certSet{
+		enabled:      config.Enabled(),
+		certificates: certificates,
+		minVersion:   tlsVersions[config.MinVersion],
+	}, nil
+}
+
+// install makes the certificates read by read the current ones.
+func (s *certStore) install(set *certSet) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.loaded = true
+	s.enabled = set.enabled
+	s.certificates = set.certificates
+	s.minVersion = set.minVersion
+}
+
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if len(s.certificates) == 0 {
+		return nil, fmt.Errorf("no certificates")
+	}
+	for i := range s.certificates {
+		if hello.SupportsCertificate(&s.certificates[i]) == nil {
+			return &s.certificates[i], nil
+		}
+	}
+	return &s.certificates[0], nil
+}
+
+// tlsConfig returns the TLS settings of the frontend, which always use the
+// certificates and the minimal version loaded last.
+func (s *certStore) tlsConfig() *tls.Config {
+	perClient := func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+		return &tls.Config{
+			GetCertificate: s.getCertificate,
+			MinVersion:     s.minVersion,
+			// Upgrades need connections that can be hijacked, so HTTP/2
+			// is not offered.
+			NextProtos: []string{"http/1.1"},
+		}, nil
+	}
+	return &tls.Config{
+		GetCertificate:     s.getCertificate,
+		GetConfigForClient: perClient,
+		NextProtos:         []string{"http/1.1"},
+	}
+}
+
+// redirectToHTTPS redirects all requests to the same URL on the HTTPS port.
+func redirectToHTTPS(port int) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+		status := http.StatusMovedPermanently
+		if r.Method != "GET" && r.Method != "HEAD" {
+			status = http.StatusPermanentRedirect
+		}
+		http.Redirect(rw, r, "https://"+host+r.URL.RequestURI(), status)
+	})
+}
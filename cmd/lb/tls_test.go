@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type TLSSuite struct{}
+
+var _ = check.Suite(&TLSSuite{})
+
+// testCertificate writes a self-signed certificate for names into dir and
+// adds it to roots.
+func testCertificate(c *check.C, dir string, roots *x509.CertPool, serial int64, names ...string) CertificateConfig {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: names[0]},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, check.IsNil)
+	leaf, err := x509.ParseCertificate(der)
+	c.Assert(err, check.IsNil)
+	if roots != nil {
+		roots.AddCert(leaf)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, check.IsNil)
+
+	files := CertificateConfig{
+		CertFile: filepath.Join(dir, names[0]+".crt"),
+		KeyFile:  filepath.Join(dir, names[0]+".key"),
+	}
+	c.Assert(ioutil.WriteFile(files.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600), check.IsNil)
+	c.Assert(ioutil.WriteFile(files.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600), check.IsNil)
+	return files
+}
+
+func tlsListener(c *check.C, store *certStore) net.Listener {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", store.tlsConfig())
+	c.Assert(err, check.IsNil)
+	go http.Serve(listener, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	return listener
+}
+
+// handshake connects to address asking for serverName and returns the
+// serial number of the presented certificate.
+func handshake(address, serverName string, roots *x509.CertPool, maxVersion uint16) (int64, error) {
+	conn, err := tls.Dial("tcp", address, &tls.Config{ServerName: serverName, RootCAs: roots, MaxVersion: maxVersion})
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), nil
+}
+
+func (s *TLSSuite) TestNormalize(c *check.C) {
+	config := TLSConfig{}
+	c.Assert(config.normalize(), check.IsNil)
+	c.Check(config.MinVersion, check.Equals, "1.2")
+	c.Check(config.Enabled(), check.Equals, false)
+
+	config = TLSConfig{MinVersion: "1.4"}
+	c.Check(config.normalize(), check.NotNil)
+	config = TLSConfig{Certificates: []CertificateConfig{{CertFile: "lb.crt"}}}
+	c.Check(config.normalize(), check.NotNil)
+}
+
+func (s *TLSSuite) TestSNI(c *check.C) {
+	dir := c.MkDir()
+	roots := x509.NewCertPool()
+	config := TLSConfig{Certificates: []CertificateConfig{
+		testCertificate(c, dir, roots, 1, "a.example.com"),
+		testCertificate(c, dir, roots, 2, "b.example.com", "*.b.example.com"),
+	}}
+	c.Assert(config.normalize(), check.IsNil)
+	store := &certStore{}
+	set, err := store.read(config)
+	c.Assert(err, check.IsNil)
+	store.install(set)
+	listener := tlsListener(c, store)
+	defer listener.Close()
+	address := listener.Addr().String()
+
+	serial, err := handshake(address, "a.example.com", roots, 0)
+	c.Assert(err, check.IsNil)
+	c.Check(serial, check.Equals, int64(1))
+	serial, err = handshake(address, "x.b.example.com", roots, 0)
+	c.Assert(err, check.IsNil)
+	c.Check(serial, check.Equals, int64(2))
+
+	_, err = handshake(address, "a.example.com", roots, tls.VersionTLS11)
+	c.Check(err, check.NotNil)
+}
+
+func (s *TLSSuite) TestReload(c *check.C) {
+	dir := c.MkDir()
+	roots := x509.NewCertPool()
+	config := TLSConfig{Certificates: []CertificateConfig{testCertificate(c, dir, roots, 1, "lb.example.com")}}
+	c.Assert(config.normalize(), check.IsNil)
+	store := &certStore{}
+	set, err := store.read(config)
+	c.Assert(err, check.IsNil)
+	store.install(set)
+	listener := tlsListener(c, store)
+	defer listener.Close()
+
+	// The files are replaced, the frontend picks the new certificate up on
+	// the next load.
+	testCertificate(c, dir, roots, 3, "lb.example.com")
+	serial, err := handshake(listener.Addr().String(), "lb.example.com", roots, 0)
+	c.Assert(err, check.IsNil)
+	c.Check(serial, check.Equals, int64(1))
+	set, err = store.read(config)
+	c.Assert(err, check.IsNil)
+	store.install(set)
+	serial, err = handshake(listener.Addr().String(), "lb.example.com", roots, 0)
+	c.Assert(err, check.IsNil)
+	c.Check(serial, check.Equals, int64(3))
+
+	_, err = store.read(TLSConfig{MinVersion: "1.2"})
+	c.Check(err, check.NotNil)
+}
+
+func (s *TLSSuite) TestRedirect(c *check.C) {
+	rw := serve(redirectToHTTPS(8443), "GET", "http://lb.example.com:8080/path?key=1", "")
+	c.Check(rw.Code, check.Equals, http.StatusMovedPermanently)
+	c.Check(rw.Header().Get("Location"), check.Equals, "https://lb.example.com:8443/path?key=1")
+
+	rw = serve(redirectToHTTPS(443), "POST", "http://lb.example.com/data", "value")
+	c.Check(rw.Code, check.Equals, http.StatusPermanentRedirect)
+	c.Check(rw.Header().Get("Location"), check.Equals, "https://lb.example.com/data")
+}
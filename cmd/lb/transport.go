@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// TransportConfig tunes the connections to every backend. Each backend keeps
+// up to MaxIdleConnsPerHost idle connections for IdleConnTimeout and opens
+// at most MaxConnsPerHost connections at once, no limit if it is zero.
+// DialTimeout and TLSHandshakeTimeout bound setting a connection up,
+// KeepAlive is the TCP keep-alive period, negative to turn it off.
+type TransportConfig struct {
+	MaxIdleConnsPerHost int      `json:"maxIdleConnsPerHost"`
+	MaxConnsPerHost     int      `json:"maxConnsPerHost"`
+	IdleConnTimeout     Duration `json:"idleConnTimeout"`
+	DialTimeout         Duration `json:"dialTimeout"`
+	TLSHandshakeTimeout Duration `json:"tlsHandshakeTimeout"`
+	KeepAlive           Duration `json:"keepAlive"`
+}
+
+func (c *TransportConfig) normalize() error {
+	if c.MaxIdleConnsPerHost < 0 || c.MaxConnsPerHost < 0 || c.IdleConnTimeout < 0 ||
+		c.DialTimeout < 0 || c.TLSHandshakeTimeout < 0 {
+		return fmt.Errorf("transport settings can not be negative")
+	}
+	if c.MaxIdleConnsPerHost == 0 {
+		c.MaxIdleConnsPerHost = 64
+	}
+	if c.IdleConnTimeout == 0 {
+		c.IdleConnTimeout = Duration(90 * time.Second)
+	}
+	if c.DialTimeout == 0 {
+		c.DialTimeout = Duration(5 * time.Second)
+	}
+	if c.TLSHandshakeTimeout == 0 {
+		c.TLSHandshakeTimeout = Duration(10 * time.Second)
+	}
+	if c.KeepAlive == 0 {
+		c.KeepAlive = Duration(30 * time.Second)
+	}
+	return nil
+}
+
+// ConnectionStats counts the connections to a backend.
+type ConnectionStats struct {
+	Open         int64
+	Opened       uint64
+	Reused       uint64
+	DialFailures uint64
+}
+
+// backendTransport is the transport of a single backend, it counts the
+// connections it makes in the metrics of the backend.
+type backendTransport struct {
+	*http.Transport
+	dialer  *net.Dialer
+	metrics *backendMetrics
+}
+
+func newBackendTransport(config TransportConfig, tlsConfig *tls.Config, metrics *backendMetrics) *backendTransport {
+	t := &backendTransport{
+		dialer: &net.Dialer{
+			Timeout:   time.Duration(config.DialTimeout),
+			KeepAlive: time.Duration(config.KeepAlive),
+		},
+		metrics: metrics,
+	}
+	t.Transport = http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = t.dial
+	// The transport only ever connects to a single host.
+	t.MaxIdleConns = 0
+	t.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	t.MaxConnsPerHost = config.MaxConnsPerHost
+	t.IdleConnTimeout = time.Duration(config.IdleConnTimeout)
+	t.TLSHandshakeTimeout = time.Duration(config.TLSHandshakeTimeout)
+	if tlsConfig != nil {
+		// The transport changes its TLS settings, the ones of the pool are
+		// shared by all backends.
+		t.TLSClientConfig = tlsConfig.Clone()
+	}
+	return t
+}
+
+func (t *backendTransport) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := t.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		t.metrics.dialFailure()
+		return nil, err
+	}
+	t.metrics.connectionOpened()
+	return &countedConn{Conn: conn, metrics: t.metrics}, nil
+}
+
+func (t *backendTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				t.metrics.connectionReused()
+			}
+		},
+	}
+	return t.Transport.RoundTrip(r.WithContext(httptrace.WithClientTrace(r.Context(), trace)))
+}
+
+// countedConn counts itself out of the open connections once it is closed.
+type countedConn struct {
+	net.Conn
+	metrics *backendMetrics
+	once    sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(c.metrics.connectionClosed)
+	return c.Conn.Close()
+}
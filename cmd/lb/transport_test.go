@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type TransportSuite struct{}
+
+var _ = check.Suite(&TransportSuite{})
+
+func (s *TransportSuite) TestNormalize(c *check.C) {
+	config := TransportConfig{KeepAlive: -1}
+	c.Assert(config.normalize(), check.IsNil)
+	c.Check(config.MaxIdleConnsPerHost, check.Equals, 64)
+	c.Check(config.MaxConnsPerHost, check.Equals, 0)
+	c.Check(config.DialTimeout, check.Equals, Duration(5*time.Second))
+	c.Check(config.KeepAlive, check.Equals, Duration(-1))
+
+	config = TransportConfig{MaxConnsPerHost: -1}
+	c.Check(config.normalize(), check.NotNil)
+}
+
+func (s *TransportSuite) TestConnectionReuse(c *check.C) {
+	backend, address := testBackend(c, "backend", 0)
+	defer backend.Close()
+	pool := testPool(c, &roundRobin{}, address)
+	defer pool.Stop()
+	handler := &proxy{pool: pool}
+
+	for i := 0; i < 3; i++ {
+		c.Assert(serve(handler, "GET", "/", "").Code, check.Equals, http.StatusOK)
+	}
+	connections := pool.Servers()[0].Connections()
+	c.Check(connections.Opened, check.Equals, uint64(1))
+	c.Check(connections.Reused, check.Equals, uint64(2))
+	c.Check(connections.Open, check.Equals, int64(1))
+
+	rw := serve(metricsHandler(singlePool(pool)), "GET", "/metrics", "")
+	c.Check(strings.Contains(rw.Body.String(), `lb_backend_connections_reused_total{pool="default",backend="`+address+`"} 2`), check.Equals, true)
+
+	// New settings close the idle connections made with the old ones.
+	config := TransportConfig{MaxIdleConnsPerHost: 1}
+	c.Assert(config.normalize(), check.IsNil)
+	pool.SetTransport(config)
+	waitFor(c, func() bool { return pool.Servers()[0].Connections().Open == 0 })
+}
+
+func (s *TransportSuite) TestDialFailure(c *check.C) {
+	pool := testPool(c, &roundRobin{}, deadAddress(c))
+	defer pool.Stop()
+
+	c.Check(serve(&proxy{pool: pool}, "GET", "/", "").Code, check.Not(check.Equals), http.StatusOK)
+	connections := pool.Servers()[0].Connections()
+	c.Check(connections.DialFailures > 0, check.Equals, true)
+	c.Check(connections.Open, check.Equals, int64(0))
+}
+
+func (s *TransportSuite) TestRedirectsArePassedOn(c *check.C) {
+	var followed int32
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&followed, 1)
+	}))
+	defer target.Close()
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		http.Redirect(rw, r, target.URL+"/elsewhere", http.StatusFound)
+	}))
+	defer backend.Close()
+
+	pool := testPool(c, &roundRobin{}, backend.Listener.Addr().String())
+	defer pool.Stop()
+	rw := serve(&proxy{pool: pool}, "GET", "/", "")
+	c.Check(rw.Code, check.Equals, http.StatusFound)
+	c.Check(rw.Header().Get("Location"), check.Equals, target.URL+"/elsewhere")
+	c.Check(atomic.LoadInt32(&followed), check.Equals, int32(0))
+}
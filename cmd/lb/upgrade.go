@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// UpgradeConfig controls the requests switching the connection to another
+// protocol, like WebSocket. Once switched, the connection is spliced with a
+// connection to the backend until either side closes it or nothing is sent
+// either way for IdleTimeout. Disabled upgrades are forwarded as plain
+// requests without the Upgrade header.
+type UpgradeConfig struct {
+	Disabled    bool     `json:"disabled"`
+	IdleTimeout Duration `json:"idleTimeout"`
+}
+
+func (c *UpgradeConfig) normalize() error {
+	if c.IdleTimeout < 0 {
+		return fmt.Errorf("upgrade idle timeout can not be negative")
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = Duration(5 * time.Minute)
+	}
+	return nil
+}
+
+// isUpgrade reports whether r asks to switch the connection to another
+// protocol.
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, option := range headerList(r.Header, "Connection") {
+		if strings.EqualFold(option, "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// upgrade forwards the upgrade request r to a backend of the pool of route
+// and, if the backend switches protocols, splices the client connection
+// with the backend one. Like forward, it returns an error if a response was
+// cut short.
+func (p *proxy) upgrade(route *route, rw http.ResponseWriter, r *http.Request, entry *accessEntry) error {
+	pool := route.pool
+	config := pool.Upgrade()
+	streaming := pool.Streaming()
+	retry, _ := pool.Retry()
+
+	server, err := p.pick(pool, r, nil)
+	if err != nil {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		rw.Write([]byte(err.Error()))
+		return nil
+	}
+	defer server.track()()
+	entry.Backend = server.Name
+
+	start := time.Now()
+	backend, resp, err := dialUpgrade(*server, r, time.Duration(retry.PerTryTimeout))
+	entry.UpstreamLatency = time.Since(start)
+	status := http.StatusServiceUnavailable
+	if err == nil {
+		status = resp.StatusCode
+		entry.UpstreamStatus = status
+	}
+	pool.Report(server, status, err, entry.UpstreamLatency)
+	if err != nil {
+		log.Printf("Failed to upgrade connection to %s: %s", server.Name, err)
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return nil
+	}
+	defer backend.Close()
+	route.rewriteResponse(resp.Header, r)
+	pool.Sticky().stick(rw, r, *server)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return copyResponse(rw, resp, *server, streaming.flushInterval(resp))
+	}
+
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		log.Printf("Failed to upgrade connection to %s: client connection can not be hijacked", server.Name)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return nil
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("Failed to upgrade connection to %s: %s", server.Name, err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return nil
+	}
+	defer client.Close()
+
+	protocol := resp.Header.Get("Upgrade")
+	removeHopHeaders(resp.Header)
+	for k, values := range rw.Header() {
+		resp.Header[k] = values
+	}
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", protocol)
+	if *traceEnabled {
+		resp.Header.Set("lb-from", server.Name)
+		resp.Header.Set("lb-breaker", server.Breaker)
+	}
+	fmt.Fprintf(buffered, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(buffered)
+	buffered.WriteString("\r\n")
+	if err := buffered.Flush(); err != nil {
+		log.Printf("Failed to write response: %s", err)
+		return nil
+	}
+	// The client may have sent data right after the request.
+	if n := buffered.Reader.Buffered(); n > 0 {
+		data, _ := buffered.Reader.Peek(n)
+		if _, err := backend.Write(data); err != nil {
+			log.Printf("Failed to write to %s: %s", server.Name, err)
+			return nil
+		}
+	}
+	tunnel(client, backend, time.Duration(config.IdleTimeout))
+	return nil
+}
+
+// dialUpgrade sends the upgrade request r to dst over a new connection and
+// reads the response, giving up after timeout.
+func dialUpgrade(dst Server, r *http.Request, timeout time.Duration) (net.Conn, *http.Response, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	conn, err := dst.dial(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if dst.Scheme == "https" {
+		conn = tls.Client(conn, dst.tlsConfig())
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	fwdRequest := r.Clone(r.Context())
+	fwdRequest.RequestURI = ""
+	fwdRequest.URL.Host = dst.Name
+	fwdRequest.URL.Scheme = dst.Scheme
+	fwdRequest.Host = dst.Name
+	protocol := r.Header.Get("Upgrade")
+	// The other hop-by-hop headers of the client are removed by ServeHTTP.
+	fwdRequest.Header.Del("Te")
+	fwdRequest.Header.Set("Connection", "Upgrade")
+	fwdRequest.Header.Set("Upgrade", protocol)
+	if err := fwdRequest.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, fwdRequest)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, reader: reader}, resp, nil
+}
+
+// bufferedConn reads what was buffered while reading the response first.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// tunnel copies data between the connections both ways until either side
+// closes its connection or nothing is sent for idle.
+func tunnel(client, backend net.Conn, idle time.Duration) {
+	touch := func() {
+		deadline := time.Now().Add(idle)
+		client.SetDeadline(deadline)
+		backend.SetDeadline(deadline)
+	}
+	done := make(chan struct{}, 2)
+	splice := func(dst, src net.Conn) {
+		defer func() { done <- struct{}{} }()
+		buffer := make([]byte, 32<<10)
+		for {
+			touch()
+			n, err := src.Read(buffer)
+			if n > 0 {
+				if _, err := dst.Write(buffer[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	go splice(backend, client)
+	go splice(client, backend)
+	<-done
+	client.Close()
+	backend.Close()
+	<-done
+}
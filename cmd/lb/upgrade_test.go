@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type UpgradeSuite struct{}
+
+var _ = check.Suite(&UpgradeSuite{})
+
+// echoBackend switches to the "echo" protocol and sends back everything it
+// receives.
+func echoBackend(c *check.C) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, buffered, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(buffered, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		buffered.Flush()
+		io.Copy(conn, buffered)
+	}))
+}
+
+func upgradeRequest(c *check.C, address, protocol string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", address)
+	c.Assert(err, check.IsNil)
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: lb\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", protocol)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	c.Assert(err, check.IsNil)
+	return conn, reader, resp
+}
+
+func upgradePool(c *check.C, idle time.Duration, addresses ...string) *Pool {
+	pool := testPool(c, &roundRobin{}, addresses...)
+	config := UpgradeConfig{IdleTimeout: Duration(idle)}
+	c.Assert(config.normalize(), check.IsNil)
+	pool.SetUpgrade(config)
+	return pool
+}
+
+func (s *UpgradeSuite) TestIsUpgrade(c *check.C) {
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("Upgrade", "websocket")
+	c.Check(isUpgrade(r), check.Equals, false)
+	r.Header.Set("Connection", "keep-alive, Upgrade")
+	c.Check(isUpgrade(r), check.Equals, true)
+}
+
+func (s *UpgradeSuite) TestTunnel(c *check.C) {
+	backend := echoBackend(c)
+	defer backend.Close()
+	pool := upgradePool(c, time.Minute, backend.Listener.Addr().String())
+	defer pool.Stop()
+	*traceEnabled = true
+	defer func() { *traceEnabled = false }()
+	frontend := httptest.NewServer(&proxy{pool: pool})
+	defer frontend.Close()
+
+	conn, reader, resp := upgradeRequest(c, frontend.Listener.Addr().String(), "echo")
+	defer conn.Close()
+	c.Check(resp.StatusCode, check.Equals, http.StatusSwitchingProtocols)
+	c.Check(resp.Header.Get("Upgrade"), check.Equals, "echo")
+	c.Check(resp.Header.Get("lb-from"), check.Equals, backend.Listener.Addr().String())
+	c.Check(resp.Header.Get(requestIDHeader), check.Not(check.Equals), "")
+	c.Check(pool.Servers()[0].ActiveConnections(), check.Equals, int64(1))
+
+	for _, message := range []string{"hello", "world"} {
+		_, err := conn.Write([]byte(message))
+		c.Assert(err, check.IsNil)
+		echo := make([]byte, len(message))
+		_, err = io.ReadFull(reader, echo)
+		c.Assert(err, check.IsNil)
+		c.Check(string(echo), check.Equals, message)
+	}
+
+	conn.Close()
+	waitFor(c, func() bool { return pool.Servers()[0].ActiveConnections() == 0 })
+}
+
+func (s *UpgradeSuite) TestIdleTimeout(c *check.C) {
+	backend := echoBackend(c)
+	defer backend.Close()
+	pool := upgradePool(c, 50*time.Millisecond, backend.Listener.Addr().String())
+	defer pool.Stop()
+	frontend := httptest.NewServer(&proxy{pool: pool})
+	defer frontend.Close()
+
+	conn, reader, resp := upgradeRequest(c, frontend.Listener.Addr().String(), "echo")
+	defer conn.Close()
+	c.Check(resp.StatusCode, check.Equals, http.StatusSwitchingProtocols)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := reader.ReadByte()
+	c.Check(err, check.Equals, io.EOF)
+}
+
+func (s *UpgradeSuite) TestRefused(c *check.C) {
+	backend := echoBackend(c)
+	defer backend.Close()
+	pool := upgradePool(c, time.Minute, backend.Listener.Addr().String())
+	defer pool.Stop()
+	frontend := httptest.NewServer(&proxy{pool: pool})
+	defer frontend.Close()
+
+	conn, _, resp := upgradeRequest(c, frontend.Listener.Addr().String(), "websocket")
+	defer conn.Close()
+	c.Check(resp.StatusCode, check.Equals, http.StatusBadRequest)
+}
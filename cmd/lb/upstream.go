@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+// UpstreamTLSConfig sets up the TLS connections to the backends with the
+// https scheme. Backend certificates are verified against the CA bundle in
+// CAFile, or the system roots if it is empty, and the certificate in
+// CertFile and KeyFile is presented to backends asking for one. ServerName
+// overrides the name the backend certificates are checked for.
+// InsecureSkipVerify turns the verification off and is meant for test
+// environments only.
+type UpstreamTLSConfig struct {
+	CAFile             string `json:"caFile"`
+	CertFile           string `json:"certFile"`
+	KeyFile            string `json:"keyFile"`
+	ServerName         string `json:"serverName"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+}
+
+func (c *UpstreamTLSConfig) normalize() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("upstream client certificate needs both a cert and a key file")
+	}
+	return nil
+}
+
+// build reads the files of the config and returns the TLS settings for the
+// backend connections.
+func (c *UpstreamTLSConfig) build() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.InsecureSkipVerify {
+		log.Printf("WARNING: backend certificates are not verified, do not use insecureSkipVerify in production")
+	}
+	if c.CAFile != "" {
+		bundle, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %s", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate %s: %s", c.CertFile, err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
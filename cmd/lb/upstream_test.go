@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	"gopkg.in/check.v1"
+)
+
+type UpstreamSuite struct{}
+
+var _ = check.Suite(&UpstreamSuite{})
+
+// mutualTLSBackend returns a backend presenting the certificate in files and
+// accepting only clients with a certificate from clients.
+func mutualTLSBackend(c *check.C, files CertificateConfig, clients *x509.CertPool) *httptest.Server {
+	certificate, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+	c.Assert(err, check.IsNil)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(rw, "hello %s", r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clients,
+	}
+	backend.StartTLS()
+	return backend
+}
+
+func (s *UpstreamSuite) TestNormalize(c *check.C) {
+	config := UpstreamTLSConfig{CertFile: "client.crt"}
+	c.Check(config.normalize(), check.NotNil)
+
+	config = UpstreamTLSConfig{CAFile: "missing.crt"}
+	c.Assert(config.normalize(), check.IsNil)
+	_, err := config.build()
+	c.Check(err, check.NotNil)
+}
+
+func setUpstreamTLS(c *check.C, pool *Pool, config UpstreamTLSConfig) {
+	tlsConfig, err := pool.buildUpstreamTLS(config)
+	c.Assert(err, check.IsNil)
+	pool.setUpstreamTLS(config, tlsConfig)
+}
+
+func (s *UpstreamSuite) TestMutualTLS(c *check.C) {
+	dir := c.MkDir()
+	clients := x509.NewCertPool()
+	server := testCertificate(c, dir, nil, 1, "backend.test")
+	client := testCertificate(c, dir, clients, 2, "lb.test")
+	backend := mutualTLSBackend(c, server, clients)
+	defer backend.Close()
+
+	pool := NewPool(&roundRobin{})
+	defer pool.Stop()
+	config := UpstreamTLSConfig{
+		CAFile:     server.CertFile,
+		CertFile:   client.CertFile,
+		KeyFile:    client.KeyFile,
+		ServerName: "backend.test",
+	}
+	c.Assert(config.normalize(), check.IsNil)
+	setUpstreamTLS(c, pool, config)
+	backendConfig := testBackendConfig(backend.Listener.Addr().String())
+	backendConfig.Scheme = "https"
+	pool.Update([]BackendConfig{backendConfig})
+	// The health checks go through the same transport.
+	waitFor(c, func() bool { return pool.Servers()[0].IsAlive })
+
+	rw := serve(&proxy{pool: pool}, "GET", "/", "")
+	c.Check(rw.Code, check.Equals, http.StatusOK)
+	c.Check(rw.Body.String(), check.Equals, "hello lb.test")
+
+	// Without the client certificate the backend refuses the connection.
+	config = UpstreamTLSConfig{CAFile: server.CertFile, ServerName: "backend.test"}
+	setUpstreamTLS(c, pool, config)
+	rw = serve(&proxy{pool: pool}, "GET", "/", "")
+	c.Check(rw.Code, check.Not(check.Equals), http.StatusOK)
+
+	// Nor does the certificate of the backend match its address.
+	config = UpstreamTLSConfig{CAFile: server.CertFile, CertFile: client.CertFile, KeyFile: client.KeyFile}
+	setUpstreamTLS(c, pool, config)
+	rw = serve(&proxy{pool: pool}, "GET", "/", "")
+	c.Check(rw.Code, check.Not(check.Equals), http.StatusOK)
+
+	config.InsecureSkipVerify = true
+	setUpstreamTLS(c, pool, config)
+	rw = serve(&proxy{pool: pool}, "GET", "/", "")
+	c.Check(rw.Code, check.Equals, http.StatusOK)
+}
@@ -14,6 +14,7 @@ import (
 
 var port = flag.Int("port", 8080, "server port")
 var dbBaseAddress = flag.String("dbBaseAddress", "http://db:2361", "base address of db")
+var shutdownTimeoutSec = flag.Int("shutdown-timeout-sec", 10, "how long to wait for in-flight requests on shutdown in seconds")
 
 const confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
 const confHealthFailure = "CONF_HEALTH_FAILURE"
@@ -97,6 +98,8 @@ func main() {
 			},
 		},
 	)
-	router.Start(*port)
+	server := httptools.CreateServer(*port, router.Handler(), httptools.NoTimeouts())
+	server.Start()
 	signal.WaitForTerminationSignal()
+	httptools.ShutdownAll(time.Duration(*shutdownTimeoutSec)*time.Second, server)
 }
@@ -23,7 +23,7 @@ func NewRouter(routes []Route) *Router {
 	return &Router{routes: routes}
 }
 
-func (r *Router) Start(port int) {
+func (r *Router) Handler() http.Handler {
 	router := mux.NewRouter().StrictSlash(true)
 	for _, route := range r.routes {
 		router.
@@ -32,7 +32,11 @@ func (r *Router) Start(port int) {
 			Name(route.Name).
 			Handler(route.HandlerFunc)
 	}
-	err := http.ListenAndServe(":"+fmt.Sprint(port), router)
+	return router
+}
+
+func (r *Router) Start(port int) {
+	err := http.ListenAndServe(":"+fmt.Sprint(port), r.Handler())
 	if err != nil {
 		log.Fatal(err)
 	}
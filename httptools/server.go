@@ -1,14 +1,20 @@
 package httptools
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"time"
 )
 
 type Server interface {
 	Start()
+	// Shutdown stops accepting new connections and waits for the requests in
+	// progress to finish until ctx is done.
+	Shutdown(ctx context.Context) error
 }
 
 type server struct {
@@ -18,19 +24,89 @@ type server struct {
 func (s server) Start() {
 	go func() {
 		log.Println("Staring the HTTP server...")
-		err := s.httpServer.ListenAndServe()
+		var err error
+		if s.httpServer.TLSConfig != nil {
+			err = s.httpServer.ListenAndServeTLS("", "")
+		} else {
+			err = s.httpServer.ListenAndServe()
+		}
+		if err == http.ErrServerClosed {
+			return
+		}
 		log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
 	}()
 }
 
-func CreateServer(port int, handler http.Handler) Server {
-	return server{
-		httpServer: &http.Server{
-			Addr:           fmt.Sprintf(":%d", port),
-			Handler:        handler,
-			ReadTimeout:    10 * time.Second,
-			WriteTimeout:   10 * time.Second,
-			MaxHeaderBytes: 1 << 20,
-		},
+func (s server) Shutdown(ctx context.Context) error {
+	log.Println("Stopping the HTTP server...")
+	return s.httpServer.Shutdown(ctx)
+}
+
+// Option changes the defaults of a server made by CreateServer.
+type Option func(s *http.Server)
+
+// NoWriteTimeout removes the write timeout, for handlers that stream long
+// responses and limit the time to write them themselves.
+func NoWriteTimeout() Option {
+	return func(s *http.Server) {
+		s.WriteTimeout = 0
+	}
+}
+
+// NoTimeouts removes the read and write timeouts, like http.ListenAndServe,
+// for handlers that may take long to answer.
+func NoTimeouts() Option {
+	return func(s *http.Server) {
+		s.ReadTimeout = 0
+		s.WriteTimeout = 0
+	}
+}
+
+// ConnContext makes the server derive the context of the requests of every
+// connection with f, see http.Server.ConnContext.
+func ConnContext(f func(ctx context.Context, c net.Conn) context.Context) Option {
+	return func(s *http.Server) {
+		s.ConnContext = f
+	}
+}
+
+// TLS makes the server accept only TLS connections set up by config. The
+// certificates have to be provided by config.
+func TLS(config *tls.Config) Option {
+	return func(s *http.Server) {
+		s.TLSConfig = config
+	}
+}
+
+func CreateServer(port int, handler http.Handler, options ...Option) Server {
+	httpServer := &http.Server{
+		Addr:           fmt.Sprintf(":%d", port),
+		Handler:        handler,
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+	for _, option := range options {
+		option(httpServer)
+	}
+	return server{httpServer: httpServer}
+}
+
+// ShutdownAll shuts the servers down in parallel, giving them timeout to
+// finish the requests in progress.
+func ShutdownAll(timeout time.Duration, servers ...Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done := make(chan struct{}, len(servers))
+	for _, s := range servers {
+		go func(s Server) {
+			if err := s.Shutdown(ctx); err != nil {
+				log.Printf("Failed to stop the HTTP server gracefully: %s", err)
+			}
+			done <- struct{}{}
+		}(s)
+	}
+	for range servers {
+		<-done
 	}
 }
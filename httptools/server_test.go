@@ -0,0 +1,93 @@
+package httptools
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestShutdownAll(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	port := freePort(t)
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	server := CreateServer(port, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		rw.Write([]byte("done"))
+	}), NoTimeouts())
+	server.Start()
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Server did not start: %s", err)
+		}
+	}
+
+	type result struct {
+		body string
+		err  error
+	}
+	response := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + address + "/")
+		if err != nil {
+			response <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		response <- result{string(body), err}
+	}()
+	<-started
+
+	stopped := make(chan struct{})
+	go func() {
+		ShutdownAll(5*time.Second, server)
+		close(stopped)
+	}()
+
+	// New connections are refused while the request in progress goes on.
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("Server still accepts connections after shutdown started")
+		}
+	}
+	select {
+	case <-stopped:
+		t.Fatal("Shutdown did not wait for the request in progress")
+	default:
+	}
+
+	close(release)
+	if r := <-response; r.err != nil || r.body != "done" {
+		t.Errorf("Unexpected response to the request in progress: %q, %v", r.body, r.err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("Shutdown did not finish after the request in progress")
+	}
+}
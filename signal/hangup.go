@@ -0,0 +1,20 @@
+package signal
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// OnHangup calls handler every time the process receives SIGHUP.
+func OnHangup(handler func()) {
+	hupChannel := make(chan os.Signal, 1)
+	signal.Notify(hupChannel, syscall.SIGHUP)
+	go func() {
+		for range hupChannel {
+			log.Println("Reloading...")
+			handler()
+		}
+	}()
+}